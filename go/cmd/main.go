@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"net/http"
+	"os"
 
 	"github.com/Embiggenerd/spiritio/pkg/config"
 	"github.com/Embiggenerd/spiritio/pkg/db"
@@ -36,5 +37,6 @@ func main() {
 	usersService := users.NewUsersService(ctx, cfg, logger, db)
 	apiServer := server.NewServer(ctx, cfg, logger, roomsService, usersService)
 
+	go apiServer.RunConsole(os.Stdin)
 	apiServer.Run()
 }
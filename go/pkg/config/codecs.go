@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VideoCodecNames and AudioCodecNames are the codecs a policy can name, matched without regard to case
+var (
+	VideoCodecNames = []string{"vp8", "h264", "vp9", "av1"}
+	AudioCodecNames = []string{"opus", "g722", "pcmu", "pcma"}
+)
+
+// CodecPolicy lists the codecs a room will negotiate, in order of preference
+type CodecPolicy struct {
+	VideoCodecs []string
+	AudioCodecs []string
+	OpusDTX     bool
+	OpusFEC     bool
+}
+
+// CodecPolicy returns the codec policy for the room with the given slug. RoomCodecs holds one entry per room,
+// formatted as "<slug>:<setting>=<value>&<setting>=<value>;...", where each setting is one of videocodecs,
+// audiocodecs, opusdtx or opusfec and overrides the global setting of the same name, e.g.
+// "town-hall:videocodecs=H264,VP8&opusdtx=true". A room picks its policy up when it opens, so a room whose
+// slug changes keeps its codecs until it next opens.
+func (c *Config) CodecPolicy(slug string) CodecPolicy {
+	// Entries were validated when the config was loaded
+	policies, _ := c.roomCodecPolicies()
+	if policy, ok := policies[slug]; ok {
+		return policy
+	}
+	return c.globalCodecPolicy()
+}
+
+func (c *Config) globalCodecPolicy() CodecPolicy {
+	return CodecPolicy{
+		VideoCodecs: splitCodecs(c.VideoCodecs),
+		AudioCodecs: splitCodecs(c.AudioCodecs),
+		OpusDTX:     c.OpusDTX == "true",
+		OpusFEC:     c.OpusFEC == "true",
+	}
+}
+
+// roomCodecPolicies parses RoomCodecs into a full policy for each room it names
+func (c *Config) roomCodecPolicies() (map[string]CodecPolicy, error) {
+	policies := map[string]CodecPolicy{}
+	for _, entry := range strings.Split(c.RoomCodecs, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		slug, settings, found := strings.Cut(entry, ":")
+		slug = strings.TrimSpace(slug)
+		if !found || slug == "" {
+			return nil, fmt.Errorf("RoomCodecs entry %q must start with a room slug and a colon", entry)
+		}
+		if _, ok := policies[slug]; ok {
+			return nil, fmt.Errorf("RoomCodecs has more than one entry for room %s", slug)
+		}
+
+		policy := c.globalCodecPolicy()
+		for _, setting := range strings.Split(settings, "&") {
+			key, value, found := strings.Cut(setting, "=")
+			if !found {
+				return nil, fmt.Errorf("RoomCodecs setting %q for room %s must be formatted as <setting>=<value>", setting, slug)
+			}
+			key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+			var err error
+			switch key {
+			case "videocodecs":
+				policy.VideoCodecs = splitCodecs(value)
+			case "audiocodecs":
+				policy.AudioCodecs = splitCodecs(value)
+			case "opusdtx":
+				policy.OpusDTX, err = parseSwitch(key, value)
+			case "opusfec":
+				policy.OpusFEC, err = parseSwitch(key, value)
+			default:
+				err = fmt.Errorf("%s is not a codec setting", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("RoomCodecs entry for room %s: %w", slug, err)
+			}
+		}
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("RoomCodecs entry for room %s: %w", slug, err)
+		}
+		policies[slug] = policy
+	}
+	return policies, nil
+}
+
+// validateCodecs rejects a global or per room policy that names a codec we can't negotiate
+func (c *Config) validateCodecs() error {
+	for _, setting := range []struct{ name, value string }{{"OpusDTX", c.OpusDTX}, {"OpusFEC", c.OpusFEC}} {
+		if _, err := parseSwitch(setting.name, setting.value); err != nil {
+			return err
+		}
+	}
+	if err := c.globalCodecPolicy().validate(); err != nil {
+		return err
+	}
+	_, err := c.roomCodecPolicies()
+	return err
+}
+
+func (p CodecPolicy) validate() error {
+	lists := []struct {
+		kind   string
+		codecs []string
+		known  []string
+	}{
+		{"video", p.VideoCodecs, VideoCodecNames},
+		{"audio", p.AudioCodecs, AudioCodecNames},
+	}
+	for _, list := range lists {
+		if len(list.codecs) == 0 {
+			return fmt.Errorf("at least one %s codec is needed", list.kind)
+		}
+		for _, codec := range list.codecs {
+			if !knownCodec(codec, list.known) {
+				return fmt.Errorf("unknown %s codec %s, expected one of %s", list.kind, codec, strings.Join(list.known, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func knownCodec(codec string, known []string) bool {
+	for _, name := range known {
+		if strings.EqualFold(codec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSwitch(name, value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s must be true or false", name)
+}
+
+func splitCodecs(s string) []string {
+	codecs := []string{}
+	for _, codec := range strings.Split(s, ",") {
+		codec = strings.TrimSpace(codec)
+		if codec != "" {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoomCodecPolicy(t *testing.T) {
+	cfg := Defaults()
+	cfg.RoomCodecs = "town-hall:videocodecs=H264,VP8&audiocodecs=opus,g722&opusdtx=true&opusfec=false; standup:videocodecs=VP9"
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	townHall := cfg.CodecPolicy("town-hall")
+	want := CodecPolicy{VideoCodecs: []string{"H264", "VP8"}, AudioCodecs: []string{"opus", "g722"}, OpusDTX: true, OpusFEC: false}
+	if !reflect.DeepEqual(townHall, want) {
+		t.Errorf("town-hall policy is %+v, want %+v", townHall, want)
+	}
+
+	// Settings a room leaves out come from the global policy
+	standup := cfg.CodecPolicy("standup")
+	want = CodecPolicy{VideoCodecs: []string{"VP9"}, AudioCodecs: []string{"opus"}, OpusDTX: false, OpusFEC: true}
+	if !reflect.DeepEqual(standup, want) {
+		t.Errorf("standup policy is %+v, want %+v", standup, want)
+	}
+
+	if other := cfg.CodecPolicy("other"); !reflect.DeepEqual(other, cfg.globalCodecPolicy()) {
+		t.Errorf("a room without an entry got %+v instead of the global policy", other)
+	}
+}
+
+func TestInvalidRoomCodecs(t *testing.T) {
+	for _, roomCodecs := range []string{
+		"videocodecs=VP8",
+		":videocodecs=VP8",
+		"standup:videocodecs=H265",
+		"standup:audiocodecs=",
+		"standup:opusdtx=on",
+		"standup:bitrate=500",
+		"standup:videocodecs",
+		"standup:videocodecs=VP8;standup:videocodecs=VP9",
+	} {
+		cfg := Defaults()
+		cfg.RoomCodecs = roomCodecs
+		if err := cfg.validate(); err == nil {
+			t.Errorf("RoomCodecs %q was accepted", roomCodecs)
+		}
+	}
+}
@@ -1,20 +1,36 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	DatabaseName       string `default:"dev.db"`
-	Addr               string `default:":8080"`
-	LogFileName        string `default:"dev.log"`
-	AccessTokenSecret  string `default:"our_secret"`
-	MaxPeerConnections int    `default:"4"`
+	DatabaseName          string `default:"dev.db"`
+	Addr                  string `default:":8080"`
+	LogFileName           string `default:"dev.log"`
+	AccessTokenSecret     string `default:"our_secret"`
+	MaxPeerConnections    int    `default:"4"` // how many peers can publish into a room at once
+	MaxViewers            int    `default:"50"`
+	QualityReportInterval int    `default:"5"`
+	RoomIdleTimeout       int    `default:"300"` // seconds a room can sit empty before it is closed, 0 keeps rooms open
+	ChatWindowSize        int    `default:"50"`
+	VideoCodecs           string `default:"VP8,H264,VP9,AV1"`
+	AudioCodecs           string `default:"opus"`
+	OpusDTX               string `default:"false"`
+	OpusFEC               string `default:"true"`
+	RoomCodecs            string `default:""` // per room codec policies, see CodecPolicy
+	EgressAddrs           string `default:""`
+	MediaDir              string `default:"media"`
+	TrustedProxies        string `default:"127.0.0.1,::1"` // reverse proxies whose X-Forwarded-For we believe
 }
 
 func GetConfig() *Config {
@@ -26,32 +42,73 @@ func GetConfig() *Config {
 		log.Println(err)
 	}
 
-	cfg := Config{
-		DatabaseName: os.Getenv("databasename"),
-		Addr:         os.Getenv("addr"),
-		LogFileName:  os.Getenv("logfilename"),
+	cfg := Config{}
+	if err := load(&cfg, os.LookupEnv); err != nil {
+		log.Fatal(err)
 	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+	return &cfg
+}
+
+// Defaults returns a config with every field at its default, for code that runs without an environment such as tests
+func Defaults() *Config {
+	cfg := &Config{}
+	if err := load(cfg, func(string) (string, bool) { return "", false }); err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+// load sets every field from the environment variable named after it in lower case, or the value
+// in its default tag when that is unset or empty
+func load(cfg *Config, lookupEnv func(key string) (string, bool)) error {
 	const tagName = "default"
 
-	t := reflect.TypeOf(cfg)
+	t := reflect.TypeOf(*cfg)
+	o := reflect.ValueOf(cfg).Elem()
 
 	for i := 0; i < t.NumField(); i++ {
-		// Get the field
 		field := t.Field(i)
+		value, ok := lookupEnv(strings.ToLower(field.Name))
+		if !ok || value == "" {
+			value = field.Tag.Get(tagName)
+		}
 
-		// Get the field tag value
-		tag := field.Tag.Get(tagName)
-
-		// Get the value
-		r := reflect.ValueOf(cfg)
-		v := reflect.Indirect(r).FieldByName(field.Name)
-
-		// If value is invalid, use default value from tag
-		if v.String() == "" {
-			o := reflect.Indirect(reflect.ValueOf(&cfg))
-			o.FieldByName(field.Name).SetString(tag)
+		v := o.Field(i)
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a whole number: %w", field.Name, err)
+			}
+			v.SetInt(int64(n))
 		}
 	}
+	return nil
+}
 
-	return &cfg
+// validate rejects settings the server can't run with
+func (c *Config) validate() error {
+	positive := []struct {
+		name  string
+		value int
+	}{
+		{"MaxPeerConnections", c.MaxPeerConnections},
+		{"MaxViewers", c.MaxViewers},
+		{"QualityReportInterval", c.QualityReportInterval},
+		{"ChatWindowSize", c.ChatWindowSize},
+	}
+	for _, setting := range positive {
+		if setting.value <= 0 {
+			return fmt.Errorf("%s must be greater than 0", setting.name)
+		}
+	}
+	if c.RoomIdleTimeout < 0 {
+		return errors.New("RoomIdleTimeout can not be negative, 0 turns idle eviction off")
+	}
+	return c.validateCodecs()
 }
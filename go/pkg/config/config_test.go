@@ -0,0 +1,58 @@
+package config
+
+import (
+	"testing"
+)
+
+func lookup(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cfg := &Config{}
+	if err := load(cfg, lookup(map[string]string{"maxpeerconnections": "8", "roomidletimeout": "0", "addr": ":9090"})); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxPeerConnections != 8 || cfg.Addr != ":9090" {
+		t.Errorf("settings from the environment were not read: %+v", cfg)
+	}
+	if cfg.RoomIdleTimeout != 0 {
+		t.Errorf("a room idle timeout of 0 became %d", cfg.RoomIdleTimeout)
+	}
+	if cfg.MaxViewers != 50 || cfg.DatabaseName != "dev.db" {
+		t.Errorf("unset settings did not get their defaults: %+v", cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("turning idle eviction off was refused: %v", err)
+	}
+
+	if err := load(&Config{}, lookup(map[string]string{"maxviewers": "lots"})); err == nil {
+		t.Error("a setting that is not a number was accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, change := range map[string]func(*Config){
+		"no publishers":         func(c *Config) { c.MaxPeerConnections = 0 },
+		"negative viewers":      func(c *Config) { c.MaxViewers = -1 },
+		"no quality interval":   func(c *Config) { c.QualityReportInterval = 0 },
+		"no chat window":        func(c *Config) { c.ChatWindowSize = 0 },
+		"negative idle timeout": func(c *Config) { c.RoomIdleTimeout = -1 },
+		"unknown video codec":   func(c *Config) { c.VideoCodecs = "VP8,H265" },
+		"no audio codecs":       func(c *Config) { c.AudioCodecs = "" },
+		"opus dtx not a switch": func(c *Config) { c.OpusDTX = "yes" },
+		"bad room codecs":       func(c *Config) { c.RoomCodecs = "standup:videocodecs=H265" },
+	} {
+		cfg := Defaults()
+		change(cfg)
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+	if err := Defaults().validate(); err != nil {
+		t.Errorf("the defaults were refused: %v", err)
+	}
+}
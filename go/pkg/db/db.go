@@ -16,13 +16,21 @@ type Database struct {
 }
 
 func Init(ctx context.Context, cfg *config.Config, log logger.Logger) *Database {
-	db, err := gorm.Open(sqlite.Open("pkg/db/"+cfg.DatabaseName), &gorm.Config{})
+	database, err := Open("pkg/db/" + cfg.DatabaseName)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	database := &Database{
-		DB: db,
-	}
 	log.Info("database is initialized")
 	return database
 }
+
+// Open opens the sqlite database at path, creating it if it does not exist
+func Open(path string) (*Database, error) {
+	// Indexing messages for search makes writes take longer, so readers don't block writers (WAL),
+	// and transactions take the write lock up front so concurrent writers wait their turn instead of failing
+	db, err := gorm.Open(sqlite.Open(path+"?_journal_mode=WAL&_txlock=immediate&_busy_timeout=5000"), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	return &Database{DB: db}, nil
+}
@@ -0,0 +1,39 @@
+package rooms
+
+import "errors"
+
+var ErrRoomClosed = errors.New("room is closed")
+
+// run owns the room's state. Every read or write of visitors, the chat log or the
+// mode happens on this goroutine, in the order the commands arrive.
+func (r *ChatRoom) run() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case cmd := <-r.commands:
+			cmd()
+			if r.closed {
+				return
+			}
+		}
+	}
+}
+
+// do runs cmd on the room's goroutine and waits for it to finish. It reports false,
+// without running cmd, once the room has been closed. cmd must not call do itself.
+func (r *ChatRoom) do(cmd func()) bool {
+	finished := make(chan struct{})
+	wrapped := func() {
+		defer close(finished)
+		cmd()
+	}
+
+	select {
+	case r.commands <- wrapped:
+	case <-r.done:
+		return false
+	}
+	<-finished
+	return true
+}
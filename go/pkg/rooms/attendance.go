@@ -0,0 +1,106 @@
+package rooms
+
+import (
+	"time"
+
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+// AttendanceQuery narrows down a room's attendance. Zero values match everything.
+type AttendanceQuery struct {
+	From   time.Time
+	To     time.Time
+	UserID uint
+}
+
+// startAttendance saves a session for a visitor who just entered the room
+func (s *ChatRoomsService) startAttendance(room *ChatRoom, visitor *Visitor) {
+	session := &Visitor{RoomID: room.ID, JoinedAt: time.Now()}
+	room.WithVisitor(visitor, func(v *Visitor) {
+		session.ClientIP = v.ClientIP
+		if v.User != nil {
+			session.UserID = v.User.ID
+		}
+	})
+	if err := s.AttendanceStorage.SaveSession(session); err != nil {
+		s.log.Error(err.Error())
+		return
+	}
+	room.WithVisitor(visitor, func(v *Visitor) {
+		v.ID = session.ID
+		v.RoomID = session.RoomID
+		v.JoinedAt = session.JoinedAt
+	})
+}
+
+// attendUser records who a visitor's session belongs to once they sign in
+func (s *ChatRoomsService) attendUser(room *ChatRoom, visitor *Visitor) {
+	sessionID, userID, _ := room.session(visitor)
+	if sessionID == 0 || userID == 0 {
+		return
+	}
+	if err := s.AttendanceStorage.SetSessionUser(sessionID, userID); err != nil {
+		s.log.Error(err.Error())
+	}
+}
+
+// endAttendance closes a visitor's session as they leave the room
+func (s *ChatRoomsService) endAttendance(room *ChatRoom, visitor *Visitor) {
+	sessionID, userID, published := room.session(visitor)
+	if sessionID == 0 {
+		return
+	}
+	if err := s.AttendanceStorage.EndSession(sessionID, userID, time.Now(), published); err != nil {
+		s.log.Error(err.Error())
+	}
+}
+
+// session reads what attendance needs from a visitor, even after the room has closed
+func (r *ChatRoom) session(visitor *Visitor) (sessionID, userID uint, published bool) {
+	read := func() {
+		sessionID, published = visitor.ID, visitor.PublishedMedia
+		if visitor.User != nil {
+			userID = visitor.User.ID
+		}
+	}
+	if !r.do(read) {
+		// The room's goroutine has stopped, so nothing can change the visitor any more
+		read()
+	}
+	return sessionID, userID, published
+}
+
+// Attendance lists the sessions visitors spent in a room, oldest first
+func (s *ChatRoomsService) Attendance(room *ChatRoom, query AttendanceQuery) ([]types.AttendanceData, error) {
+	sessions, err := s.AttendanceStorage.FindSessions(room.ID, query)
+	if err != nil {
+		return nil, err
+	}
+	attendance := []types.AttendanceData{}
+	for i := range sessions {
+		attendance = append(attendance, sessions[i].AttendanceData())
+	}
+	return attendance, nil
+}
+
+// AttendanceData describes a stored session. Sessions still under way count their duration up to now.
+func (v *Visitor) AttendanceData() types.AttendanceData {
+	data := types.AttendanceData{
+		ID:             v.ID,
+		UserID:         v.UserID,
+		RoomID:         v.RoomID,
+		JoinedAt:       v.JoinedAt,
+		LeftAt:         v.LeftAt,
+		PublishedMedia: v.PublishedMedia,
+		ClientIP:       v.ClientIP,
+	}
+	if v.User != nil {
+		data.UserName = v.User.Name
+	}
+	left := time.Now()
+	if v.LeftAt != nil {
+		left = *v.LeftAt
+	}
+	data.DurationSeconds = int64(left.Sub(v.JoinedAt).Seconds())
+	return data
+}
@@ -0,0 +1,57 @@
+package rooms
+
+import (
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/db"
+)
+
+// maxAttendanceRows caps how many sessions one query returns
+const maxAttendanceRows = 10000
+
+type AttendanceStore interface {
+	SaveSession(session *Visitor) error
+	SetSessionUser(sessionID, userID uint) error
+	EndSession(sessionID, userID uint, leftAt time.Time, published bool) error
+	FindSessions(roomID uint, query AttendanceQuery) ([]Visitor, error)
+}
+
+type AttendanceStorage struct {
+	db *db.Database
+}
+
+func (s *AttendanceStorage) SaveSession(session *Visitor) error {
+	result := s.db.DB.Omit("User").Create(session)
+	return result.Error
+}
+
+func (s *AttendanceStorage) SetSessionUser(sessionID, userID uint) error {
+	result := s.db.DB.Model(&Visitor{}).Where("id = ?", sessionID).Update("user_id", userID)
+	return result.Error
+}
+
+func (s *AttendanceStorage) EndSession(sessionID, userID uint, leftAt time.Time, published bool) error {
+	result := s.db.DB.Model(&Visitor{}).Where("id = ?", sessionID).Updates(map[string]interface{}{
+		"user_id":         userID,
+		"left_at":         leftAt,
+		"published_media": published,
+	})
+	return result.Error
+}
+
+// FindSessions finds the sessions in a room that overlap the query's time range
+func (s *AttendanceStorage) FindSessions(roomID uint, query AttendanceQuery) ([]Visitor, error) {
+	sessions := []Visitor{}
+	tx := s.db.DB.Preload("User").Where("room_id = ?", roomID)
+	if !query.From.IsZero() {
+		tx = tx.Where("left_at IS NULL OR left_at >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		tx = tx.Where("joined_at <= ?", query.To)
+	}
+	if query.UserID != 0 {
+		tx = tx.Where("user_id = ?", query.UserID)
+	}
+	result := tx.Order("joined_at").Limit(maxAttendanceRows).Find(&sessions)
+	return sessions, result.Error
+}
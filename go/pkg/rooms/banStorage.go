@@ -0,0 +1,51 @@
+package rooms
+
+import (
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"gorm.io/gorm/clause"
+)
+
+type BanStore interface {
+	SaveBan(ban *RoomBan) error
+	FindActiveBan(roomID, userID uint) (*RoomBan, error)
+	GetActiveBansByRoomID(roomID uint) ([]RoomBan, error)
+	DeleteBan(roomID, userID uint) (bool, error)
+}
+
+type BanStorage struct {
+	db *db.Database
+}
+
+// SaveBan bans a user from a room, replacing any earlier ban
+func (s *BanStorage) SaveBan(ban *RoomBan) error {
+	result := s.db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "room_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"banned_by_id", "reason", "created_at", "expires_at"}),
+	}).Create(ban)
+	return result.Error
+}
+
+func (s *BanStorage) FindActiveBan(roomID, userID uint) (*RoomBan, error) {
+	ban := &RoomBan{}
+	result := s.db.DB.Where(RoomBan{RoomID: roomID, UserID: userID}).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		First(ban)
+	return ban, result.Error
+}
+
+func (s *BanStorage) GetActiveBansByRoomID(roomID uint) ([]RoomBan, error) {
+	bans := []RoomBan{}
+	result := s.db.DB.Where(RoomBan{RoomID: roomID}).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Order("created_at").
+		Find(&bans)
+	return bans, result.Error
+}
+
+// DeleteBan revokes a ban, reporting whether there was one
+func (s *BanStorage) DeleteBan(roomID, userID uint) (bool, error) {
+	result := s.db.DB.Where(RoomBan{RoomID: roomID, UserID: userID}).Delete(&RoomBan{})
+	return result.RowsAffected > 0, result.Error
+}
@@ -0,0 +1,78 @@
+package rooms
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/types"
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrBanned = errors.New("you are banned from this room")
+
+// RoomBan keeps a user out of a room until it expires or is revoked. A nil ExpiresAt never expires.
+type RoomBan struct {
+	ID         uint `gorm:"primaryKey"`
+	RoomID     uint `gorm:"uniqueIndex:idx_ban_room_user"`
+	UserID     uint `gorm:"uniqueIndex:idx_ban_room_user"`
+	BannedByID uint
+	Reason     string
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+}
+
+// Data describes the ban to clients
+func (b *RoomBan) Data() types.BanData {
+	return types.BanData{
+		RoomID:     b.RoomID,
+		UserID:     b.UserID,
+		BannedByID: b.BannedByID,
+		Reason:     b.Reason,
+		CreatedAt:  b.CreatedAt,
+		ExpiresAt:  b.ExpiresAt,
+	}
+}
+
+// Kick takes every connection a user has open out of the room, telling each why.
+// It returns the removed visitors and their PeerConnections so those can be closed.
+func (r *ChatRoom) Kick(userID uint, reason string) (kicked []*Visitor, pcs []*webrtc.PeerConnection) {
+	r.do(func() {
+		remaining := []*Visitor{}
+		for _, v := range r.visitors {
+			if v.User == nil || v.User.ID != userID {
+				remaining = append(remaining, v)
+				continue
+			}
+			v.Notify(&types.Event{Event: "kicked", Data: types.KickedData{RoomID: r.ID, Reason: reason}})
+			kicked = append(kicked, v)
+			if v.PeerConnection != nil {
+				pcs = append(pcs, v.PeerConnection)
+			}
+		}
+		r.visitors = remaining
+		r.LastActiveAt = time.Now()
+	})
+	if len(kicked) > 0 {
+		for _, v := range kicked {
+			if r.Service != nil {
+				r.Service.endAttendance(r, v)
+			}
+		}
+		r.OccupancyChanged()
+	}
+	return kicked, pcs
+}
+
+// CanRemove reports whether a visitor may kick or ban a user. Only owners can remove other moderators.
+func (v *Visitor) CanRemove(userID uint) bool {
+	allowed := false
+	v.Room.WithVisitor(v, func(v *Visitor) {
+		r := v.Room
+		if v.User == nil || v.User.ID == userID || userID == r.OwnerID || !r.can(v.User, PermModerate) {
+			return
+		}
+		targetRole := r.roles[userID]
+		allowed = (targetRole != RoleOwner && targetRole != RoleModerator) || r.can(v.User, PermSetRoles)
+	})
+	return allowed
+}
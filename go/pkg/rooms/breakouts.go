@@ -0,0 +1,320 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+const (
+	RoomClosedBreakoutsEnded = "breakouts_ended"
+
+	BreakoutAssignRandom = "random"
+	BreakoutAssignManual = "manual"
+
+	maxBreakouts = 50
+)
+
+var (
+	ErrIsBreakout    = errors.New("breakout rooms can not have breakouts of their own")
+	ErrBreakoutsOpen = errors.New("this room already has breakouts")
+	ErrNoBreakouts   = errors.New("this room has no breakouts")
+)
+
+// CreateBreakouts splits a room's participants between new breakout rooms linked to it.
+// Hosts stay in the parent unless they are assigned by hand. Everyone assigned is sent
+// moved_to_room so their client reconnects to their breakout.
+func (s *ChatRoomsService) CreateBreakouts(ctx context.Context, parent *ChatRoom, createdByID uint, detail types.CreateBreakoutsWorkOrderDetail) error {
+	if detail.Count < 1 || detail.Count > maxBreakouts {
+		return fmt.Errorf("there must be between 1 and %d breakout rooms", maxBreakouts)
+	}
+	if detail.Assignment != BreakoutAssignRandom && detail.Assignment != BreakoutAssignManual {
+		return fmt.Errorf("assignment must be %s or %s", BreakoutAssignRandom, BreakoutAssignManual)
+	}
+	if detail.Duration < 0 {
+		return errors.New("duration can not be negative")
+	}
+	for _, assignment := range detail.Assignments {
+		if assignment.Room < 1 || assignment.Room > detail.Count {
+			return fmt.Errorf("breakout room %d does not exist", assignment.Room)
+		}
+	}
+
+	parentMetadata := parent.Metadata()
+	if parentMetadata.ParentID != nil {
+		return ErrIsBreakout
+	}
+	open := false
+	if !parent.do(func() {
+		open = len(parent.breakouts) > 0 || parent.creatingBreakouts
+		if !open {
+			parent.creatingBreakouts = true
+		}
+	}) {
+		return ErrRoomClosed
+	}
+	if open {
+		return ErrBreakoutsOpen
+	}
+
+	children := []*ChatRoom{}
+	for i := 1; i <= detail.Count; i++ {
+		child, err := s.createBreakout(ctx, parent, parentMetadata, createdByID, i)
+		if err != nil {
+			// Half a set of breakouts is no use to anyone
+			if child != nil {
+				children = append(children, child)
+			}
+			for _, child := range children {
+				s.endBreakout(child.ID, child.Metadata(), child)
+			}
+			parent.do(func() {
+				parent.creatingBreakouts = false
+			})
+			return err
+		}
+		children = append(children, child)
+	}
+
+	var endsAt time.Time
+	if detail.Duration > 0 {
+		endsAt = time.Now().Add(time.Duration(detail.Duration) * time.Second)
+	}
+	var participants []uint
+	parent.do(func() {
+		for _, child := range children {
+			parent.breakouts = append(parent.breakouts, child.ID)
+		}
+		parent.creatingBreakouts = false
+		participants = parent.breakoutParticipants()
+		if !endsAt.IsZero() {
+			parent.breakoutsEnd = endsAt
+			parent.breakoutTimer = time.AfterFunc(time.Until(endsAt), func() { s.recallBreakouts(parent) })
+		}
+	})
+
+	assignments := map[uint]int{}
+	if detail.Assignment == BreakoutAssignRandom {
+		rand.Shuffle(len(participants), func(i, j int) {
+			participants[i], participants[j] = participants[j], participants[i]
+		})
+		for i, userID := range participants {
+			assignments[userID] = i%detail.Count + 1
+		}
+	}
+	for _, assignment := range detail.Assignments {
+		assignments[assignment.UserID] = assignment.Room
+	}
+
+	for userID, room := range assignments {
+		s.moveUser(parent, userID, children[room-1], endsAt)
+	}
+	return nil
+}
+
+// createBreakout creates the nth breakout of a room. The parent's owner and roles carry over, so hosts can run it too.
+// If it fails after the room was made, the room is returned along with the error so it can be cleaned up.
+func (s *ChatRoomsService) createBreakout(ctx context.Context, parent *ChatRoom, parentMetadata RoomMetadata, createdByID uint, n int) (*ChatRoom, error) {
+	child, err := s.CreateRoom(ctx, createdByID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := child.Metadata()
+	metadata.ParentID = &parent.ID
+	metadata.Name = fmt.Sprintf("Breakout %d", n)
+	if parentMetadata.Name != "" {
+		metadata.Name = fmt.Sprintf("%s: breakout %d", parentMetadata.Name, n)
+	}
+	metadata.OwnerID = parentMetadata.OwnerID
+	metadata.Settings.ChatEnabled = parentMetadata.Settings.ChatEnabled
+	metadata.Settings.VideoEnabled = parentMetadata.Settings.VideoEnabled
+	if err := s.RoomStorage.UpdateRoomMetadata(child.ID, metadata); err != nil {
+		return child, err
+	}
+	child.SetMetadata(metadata)
+
+	roles := map[uint]Role{}
+	parent.do(func() {
+		for userID, role := range parent.roles {
+			roles[userID] = role
+		}
+	})
+	for userID, role := range roles {
+		if err := s.SetRole(child, userID, role); err != nil {
+			return child, err
+		}
+	}
+	return child, nil
+}
+
+// breakoutParticipants lists the signed in users who are split up at random: everyone but the hosts.
+// It must run on the room's goroutine.
+func (r *ChatRoom) breakoutParticipants() []uint {
+	participants := []uint{}
+	seen := map[uint]bool{}
+	for _, v := range r.visitors {
+		if v.User == nil || seen[v.User.ID] || r.can(v.User, PermBreakouts) {
+			continue
+		}
+		seen[v.User.ID] = true
+		participants = append(participants, v.User.ID)
+	}
+	return participants
+}
+
+// moveUser tells every connection a user has in from to reconnect to to
+func (s *ChatRoomsService) moveUser(from *ChatRoom, userID uint, to *ChatRoom, endsAt time.Time) {
+	from.NotifyUser(userID, &types.Event{Event: "moved_to_room", Data: movedToRoomData(to, endsAt)})
+}
+
+func movedToRoomData(to *ChatRoom, endsAt time.Time) types.MovedToRoomData {
+	metadata := to.Metadata()
+	data := types.MovedToRoomData{RoomID: to.ID, Slug: metadata.Slug, Name: metadata.Name}
+	if !endsAt.IsZero() {
+		data.EndsAt = &endsAt
+	}
+	return data
+}
+
+// RecallBreakouts calls everyone back to the parent room after a countdown, or straight away without one
+func (s *ChatRoomsService) RecallBreakouts(parent *ChatRoom, countdown time.Duration) error {
+	if countdown < 0 {
+		return errors.New("countdown can not be negative")
+	}
+	if countdown == 0 {
+		if !s.recallBreakouts(parent) {
+			return ErrNoBreakouts
+		}
+		return nil
+	}
+
+	endsAt := time.Now().Add(countdown)
+	var children []uint
+	parent.do(func() {
+		children = parent.breakouts
+		if len(children) == 0 {
+			return
+		}
+		if parent.breakoutTimer != nil {
+			parent.breakoutTimer.Stop()
+		}
+		parent.breakoutsEnd = endsAt
+		parent.breakoutTimer = time.AfterFunc(countdown, func() { s.recallBreakouts(parent) })
+	})
+	if len(children) == 0 {
+		return ErrNoBreakouts
+	}
+
+	event := &types.Event{Event: "breakouts_ending", Data: types.MeetingData{RoomID: parent.ID, StartsAt: time.Now(), EndsAt: &endsAt}}
+	for _, childID := range children {
+		if child, err := s.cache.GetRoom(childID); err == nil {
+			child.BroadcastEvent(event)
+		}
+	}
+	parent.BroadcastEvent(event)
+	return nil
+}
+
+// recallBreakouts sends everyone in a room's breakouts back to it, then locks and closes the breakouts.
+// It reports whether there were any.
+func (s *ChatRoomsService) recallBreakouts(parent *ChatRoom) bool {
+	var children []uint
+	parent.do(func() {
+		children = parent.breakouts
+		parent.breakouts = nil
+		parent.breakoutsEnd = time.Time{}
+		if parent.breakoutTimer != nil {
+			parent.breakoutTimer.Stop()
+			parent.breakoutTimer = nil
+		}
+	})
+	if len(children) == 0 {
+		return false
+	}
+
+	back := &types.Event{Event: "moved_to_room", Data: movedToRoomData(parent, time.Time{})}
+	for _, childID := range children {
+		metadata, child, err := s.breakout(childID)
+		if err != nil {
+			s.log.Error(err.Error())
+			continue
+		}
+		if child != nil {
+			child.BroadcastEvent(back)
+		}
+		s.endBreakout(childID, metadata, child)
+	}
+	parent.NotifyPermitted(PermBreakouts, &types.Event{Event: "breakouts_updated", Data: s.Breakouts(parent)})
+	return true
+}
+
+// endBreakout locks a breakout that is over, so nobody wanders back into it, and closes it if it is open
+func (s *ChatRoomsService) endBreakout(childID uint, metadata RoomMetadata, child *ChatRoom) {
+	metadata.Settings.Locked = true
+	if err := s.RoomStorage.UpdateRoomMetadata(childID, metadata); err != nil {
+		s.log.Error(err.Error())
+	}
+	if child != nil {
+		child.SetMetadata(metadata)
+		s.CloseRoom(child, RoomClosedBreakoutsEnded)
+	}
+}
+
+// Breakouts describes a room's breakouts and how many people are in each
+func (s *ChatRoomsService) Breakouts(parent *ChatRoom) types.BreakoutsData {
+	var children []uint
+	var endsAt time.Time
+	parent.do(func() {
+		children = parent.breakouts
+		endsAt = parent.breakoutsEnd
+	})
+
+	data := types.BreakoutsData{ParentID: parent.ID, Rooms: []types.BreakoutData{}}
+	if !endsAt.IsZero() {
+		data.EndsAt = &endsAt
+	}
+	for _, childID := range children {
+		metadata, child, err := s.breakout(childID)
+		if err != nil {
+			s.log.Error(err.Error())
+			continue
+		}
+		breakout := types.BreakoutData{RoomID: childID, Slug: metadata.Slug, Name: metadata.Name}
+		if child != nil {
+			breakout.Visitors = child.VisitorCount()
+		}
+		data.Rooms = append(data.Rooms, breakout)
+	}
+	return data
+}
+
+// breakout looks up a breakout's metadata. The room itself is only returned when it is open,
+// since breakouts that emptied out may have been evicted, and there is no need to open them again.
+func (s *ChatRoomsService) breakout(roomID uint) (RoomMetadata, *ChatRoom, error) {
+	if room, err := s.cache.GetRoom(roomID); err == nil {
+		return room.Metadata(), room, nil
+	}
+	room, err := s.RoomStorage.FindRoomByID(roomID)
+	if err != nil {
+		return RoomMetadata{}, nil, err
+	}
+	return room.RoomMetadata, nil, nil
+}
+
+// reportBreakoutOccupancy keeps a parent room's hosts up to date as people come and go from its breakouts
+func (s *ChatRoomsService) reportBreakoutOccupancy(room *ChatRoom) {
+	parentID := room.Metadata().ParentID
+	if parentID == nil {
+		return
+	}
+	parent, err := s.cache.GetRoom(*parentID)
+	if err != nil {
+		return
+	}
+	parent.NotifyPermitted(PermBreakouts, &types.Event{Event: "breakouts_updated", Data: s.Breakouts(parent)})
+}
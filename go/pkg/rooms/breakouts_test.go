@@ -0,0 +1,52 @@
+package rooms
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+func TestCreateBreakoutsConcurrently(t *testing.T) {
+	s := newTestService(t)
+	parent := s.createRoom(t)
+	defer s.CloseRoom(parent, "test over")
+	host := s.createUser(t)
+
+	const attempts = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.CreateBreakouts(s.ctx, parent, host.ID, types.CreateBreakoutsWorkOrderDetail{Count: 2, Assignment: BreakoutAssignRandom})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrBreakoutsOpen):
+			t.Error(err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d sets of breakouts were created, want 1", created)
+	}
+	if rooms := len(s.Breakouts(parent).Rooms); rooms != 2 {
+		t.Errorf("parent has %d breakouts, want 2", rooms)
+	}
+
+	if err := s.RecallBreakouts(parent, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBreakouts(s.ctx, parent, host.ID, types.CreateBreakoutsWorkOrderDetail{Count: 1, Assignment: BreakoutAssignRandom}); err != nil {
+		t.Errorf("breakouts could not be created again after a recall: %v", err)
+	}
+}
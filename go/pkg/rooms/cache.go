@@ -8,21 +8,39 @@ import (
 type Cache interface {
 	AddRoom(room *ChatRoom)
 	GetRoom(roomID uint) (*ChatRoom, error)
+	GetRoomBySlug(slug string) (*ChatRoom, error)
+	GetOrOpen(roomID uint, open func() (*ChatRoom, error)) (room *ChatRoom, opened bool, err error)
+	RenameRoom(roomID uint, oldSlug, newSlug string)
 	UpdateChatLogs(roomID uint, chatRoomLog *ChatRoomLog)
+	RemoveRoom(roomID uint)
+	Rooms() []*ChatRoom
 }
 
 type RoomsCache struct {
 	table RoomsTable
-	mu    sync.Mutex
+	slugs map[string]uint
+	// opening holds the rooms being opened, so that everyone who asks for one meanwhile gets the same room
+	opening map[uint]*openingRoom
+	mu      sync.Mutex
+}
+
+// openingRoom is a room being opened. done is closed once room and err are set.
+type openingRoom struct {
+	done chan struct{}
+	room *ChatRoom
+	err  error
 }
 
 func (c *RoomsCache) AddRoom(room *ChatRoom) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.table[room.ID] = room
+	c.slugs[room.Slug] = room.ID
 }
 
 func (c *RoomsCache) GetRoom(roomID uint) (*ChatRoom, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	var err error
 	val, ok := c.table[roomID]
 	if !ok {
@@ -31,12 +49,86 @@ func (c *RoomsCache) GetRoom(roomID uint) (*ChatRoom, error) {
 	return val, err
 }
 
+// GetOrOpen returns the cached room with an id, or opens it and caches it. Only one caller opens a room,
+// any others asking for it at the same time wait for them. opened reports whether this caller opened it.
+func (c *RoomsCache) GetOrOpen(roomID uint, open func() (*ChatRoom, error)) (*ChatRoom, bool, error) {
+	c.mu.Lock()
+	if room, ok := c.table[roomID]; ok {
+		c.mu.Unlock()
+		return room, false, nil
+	}
+	if o, ok := c.opening[roomID]; ok {
+		c.mu.Unlock()
+		<-o.done
+		return o.room, false, o.err
+	}
+	if c.opening == nil {
+		c.opening = map[uint]*openingRoom{}
+	}
+	o := &openingRoom{done: make(chan struct{})}
+	c.opening[roomID] = o
+	c.mu.Unlock()
+
+	o.room, o.err = open()
+
+	c.mu.Lock()
+	if o.err == nil {
+		c.table[roomID] = o.room
+		c.slugs[o.room.Slug] = roomID
+	}
+	delete(c.opening, roomID)
+	c.mu.Unlock()
+	close(o.done)
+	return o.room, o.err == nil, o.err
+}
+
+func (c *RoomsCache) GetRoomBySlug(slug string) (*ChatRoom, error) {
+	c.mu.Lock()
+	roomID, ok := c.slugs[slug]
+	c.mu.Unlock()
+	if !ok {
+		return nil, errors.New("room could not be found")
+	}
+	return c.GetRoom(roomID)
+}
+
+// RenameRoom points a room's new slug at it in place of the old one
+func (c *RoomsCache) RenameRoom(roomID uint, oldSlug, newSlug string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.slugs, oldSlug)
+	c.slugs[newSlug] = roomID
+}
+
 func (c *RoomsCache) UpdateChatLogs(roomID uint, chatRoomLog *ChatRoomLog) {
+	room, err := c.GetRoom(roomID)
+	if err != nil {
+		// The room was evicted, its chat log will be reloaded from the database
+		return
+	}
+	room.AppendChatLog(*chatRoomLog)
+}
+
+func (c *RoomsCache) RemoveRoom(roomID uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.table, roomID)
+	for slug, id := range c.slugs {
+		if id == roomID {
+			delete(c.slugs, slug)
+		}
+	}
+}
+
+// Rooms returns every room currently in the cache
+func (c *RoomsCache) Rooms() []*ChatRoom {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	currentChatLogs := c.table[roomID].ChatLog
-	newChatLogs := append(currentChatLogs, *chatRoomLog)
-	c.table[roomID].ChatLog = newChatLogs
+	rooms := make([]*ChatRoom, 0, len(c.table))
+	for _, room := range c.table {
+		rooms = append(rooms, room)
+	}
+	return rooms
 }
 
 type RoomsTable map[uint]*ChatRoom
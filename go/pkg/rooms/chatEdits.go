@@ -0,0 +1,118 @@
+package rooms
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/types"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotAuthor       = errors.New("only the author can change this message")
+	ErrEmptyEdit       = errors.New("a message can not be edited to be empty, delete it instead")
+)
+
+// ChatLogEdit is the text a message had before one of its edits
+type ChatLogEdit struct {
+	ID            uint `gorm:"primaryKey"`
+	ChatRoomLogID uint `gorm:"index"`
+	Text          string
+	// EditedAt is when this text was replaced
+	EditedAt time.Time
+}
+
+// EditMessage replaces the text of one of the visitor's own messages, keeping the old text in its edit history
+func (s *ChatRoomsService) EditMessage(visitor *Visitor, id uint, text string) (types.UserMessageData, error) {
+	if strings.TrimSpace(text) == "" {
+		return types.UserMessageData{}, ErrEmptyEdit
+	}
+	chatLog, err := s.visibleChatLog(visitor, id)
+	if err != nil {
+		return types.UserMessageData{}, err
+	}
+	if chatLog.FromUserID != visitor.User.ID {
+		return types.UserMessageData{}, ErrNotAuthor
+	}
+
+	now := time.Now()
+	previous := &ChatLogEdit{ChatRoomLogID: chatLog.ID, Text: chatLog.Text, EditedAt: now}
+	chatLog.Text = text
+	chatLog.EditedAt = &now
+	if err := s.ChatStorage.EditChatLog(chatLog, previous); err != nil {
+		return types.UserMessageData{}, err
+	}
+	visitor.Room.replaceChatLog(*chatLog)
+	return chatLog.Data(), nil
+}
+
+// DeleteMessage deletes a message. Authors can delete their own messages and moderators anyone's.
+func (s *ChatRoomsService) DeleteMessage(visitor *Visitor, id uint) (types.UserMessageData, error) {
+	chatLog, err := s.visibleChatLog(visitor, id)
+	if err != nil {
+		return types.UserMessageData{}, err
+	}
+	if chatLog.FromUserID != visitor.User.ID && !visitor.Room.Allows(visitor.User, PermModerate) {
+		return types.UserMessageData{}, ErrNotAuthor
+	}
+
+	if err := s.ChatStorage.DeleteChatLog(chatLog); err != nil {
+		return types.UserMessageData{}, err
+	}
+	visitor.Room.replaceChatLog(*chatLog)
+	if chatLog.ParentID != nil {
+		s.threadChanged(visitor.Room, *chatLog.ParentID)
+	}
+	return chatLog.Data(), nil
+}
+
+// visibleChatLog finds a message in the visitor's room. Direct messages are only found by the two users they are between.
+func (s *ChatRoomsService) visibleChatLog(visitor *Visitor, id uint) (*ChatRoomLog, error) {
+	chatLog, err := s.ChatStorage.FindChatLog(visitor.Room.ID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !chatLog.visibleTo(visitor.User.ID) {
+		return nil, ErrMessageNotFound
+	}
+	return chatLog, nil
+}
+
+// replaceChatLog updates a message in the room's chat log cache, dropping it if it was deleted
+func (r *ChatRoom) replaceChatLog(chatLog ChatRoomLog) {
+	r.do(func() {
+		for i := range r.chatLog {
+			if r.chatLog[i].ID != chatLog.ID {
+				continue
+			}
+			if chatLog.DeletedAt.Valid {
+				r.chatLog = append(r.chatLog[:i:i], r.chatLog[i+1:]...)
+			} else {
+				r.chatLog[i] = chatLog
+			}
+			return
+		}
+	})
+}
+
+// NotifyMessageChanged tells whoever can see a message that it changed
+func (r *ChatRoom) NotifyMessageChanged(event string, message types.UserMessageData) {
+	r.NotifyMessageAudience(message.FromUserID, message.ToUserID, &types.Event{Event: event, Data: message})
+}
+
+// NotifyMessageAudience sends an event about a message to everyone who can see it. Direct messages only go to their two users.
+func (r *ChatRoom) NotifyMessageAudience(fromUserID, toUserID uint, ev *types.Event) {
+	if toUserID == 0 {
+		r.BroadcastEvent(ev)
+		return
+	}
+	r.NotifyUser(fromUserID, ev)
+	if toUserID != fromUserID {
+		r.NotifyUser(toUserID, ev)
+	}
+}
@@ -1,12 +1,178 @@
 package rooms
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/Embiggenerd/spiritio/types"
 	"gorm.io/gorm"
 )
 
+// ChatRoomLog is a saved chat message
 type ChatRoomLog struct {
 	gorm.Model
-	types.UserMessageData
-	RoomID uint
+	// The index covers paging by id too, since sqlite keeps the rowid in every index
+	RoomID       uint   `gorm:"index;index:idx_chat_room_seq,priority:1;uniqueIndex:idx_chat_client_message,priority:1"`
+	Seq          uint64 `gorm:"index:idx_chat_room_seq,priority:2"`
+	Text         string
+	FromUserName string
+	FromUserID   uint `gorm:"uniqueIndex:idx_chat_client_message,priority:2"`
+	UserVerified bool
+	ToUserID     uint
+	// ClientMessageID is null rather than empty when the client sent none, so the unique index ignores it
+	ClientMessageID *string `gorm:"uniqueIndex:idx_chat_client_message,priority:3"`
+	EditedAt        *time.Time
+	Reactions       []MessageReaction `gorm:"foreignKey:ChatRoomLogID"`
+	// ParentID is set on replies, which are left out of the room's main timeline
+	ParentID *uint `gorm:"index"`
+	// ReplyCount and LastReplyAt summarize a message's thread
+	ReplyCount  int
+	LastReplyAt *time.Time
+}
+
+const maxClientMessageIDLength = 64
+
+func newChatRoomLog(roomID uint, msg types.UserMessageData) *ChatRoomLog {
+	chatLog := &ChatRoomLog{
+		RoomID:       roomID,
+		Text:         msg.Text,
+		FromUserName: msg.FromUserName,
+		FromUserID:   msg.FromUserID,
+		UserVerified: msg.UserVerified,
+		ToUserID:     msg.ToUserID,
+		ParentID:     msg.ParentID,
+	}
+	if msg.ClientMessageID != "" {
+		clientMessageID := msg.ClientMessageID
+		chatLog.ClientMessageID = &clientMessageID
+	}
+	return chatLog
+}
+
+// visibleTo reports whether a user can see a message. Direct messages are only seen by their two users.
+func (c *ChatRoomLog) visibleTo(userID uint) bool {
+	return c.ToUserID == 0 || userID != 0 && (c.ToUserID == userID || c.FromUserID == userID)
+}
+
+// Data describes a saved message to clients
+func (c *ChatRoomLog) Data() types.UserMessageData {
+	data := types.UserMessageData{
+		ID:           c.ID,
+		Seq:          c.Seq,
+		SentAt:       c.CreatedAt,
+		Text:         c.Text,
+		FromUserName: c.FromUserName,
+		FromUserID:   c.FromUserID,
+		UserVerified: c.UserVerified,
+		ToUserID:     c.ToUserID,
+		EditedAt:     c.EditedAt,
+		Reactions:    reactionData(c.Reactions),
+		ParentID:     c.ParentID,
+		ReplyCount:   c.ReplyCount,
+		LastReplyAt:  c.LastReplyAt,
+	}
+	if c.ClientMessageID != nil {
+		data.ClientMessageID = *c.ClientMessageID
+	}
+	// Deleted messages keep their place, but not what they said
+	if c.DeletedAt.Valid {
+		data.Deleted = true
+		data.Text = ""
+		data.EditedAt = nil
+		data.Reactions = nil
+	}
+	return data
+}
+
+// SaveChatLog saves a message, giving it an id, a timestamp and the room's next sequence number.
+// A message whose client message id the sender already used is not saved again. The one that was
+// is returned instead, with duplicate set.
+func (s *ChatRoomsService) SaveChatLog(msg types.UserMessageData, visitor *Visitor) (saved types.UserMessageData, duplicate bool, err error) {
+	room := visitor.Room
+	if len(msg.ClientMessageID) > maxClientMessageIDLength {
+		return saved, false, fmt.Errorf("client message id can be at most %d characters", maxClientMessageIDLength)
+	}
+	if msg.ClientMessageID != "" {
+		if existing, err := s.ChatStorage.FindChatLogByClientMessageID(room.ID, msg.FromUserID, msg.ClientMessageID); err == nil {
+			return existing.Data(), true, nil
+		}
+	}
+
+	var parent *ChatRoomLog
+	if msg.ParentID != nil {
+		if parent, err = s.threadParent(visitor, *msg.ParentID); err != nil {
+			return saved, false, err
+		}
+		if msg.ToUserID, err = replyRecipient(parent, msg); err != nil {
+			return saved, false, err
+		}
+	}
+
+	chatLog := newChatRoomLog(room.ID, msg)
+	if !room.do(func() {
+		room.lastSeq++
+		chatLog.Seq = room.lastSeq
+	}) {
+		return saved, false, ErrRoomClosed
+	}
+
+	if _, err := s.ChatStorage.SaveChatlog(chatLog); err != nil {
+		// A retry may have raced the original past the lookup, in which case the unique index stopped it
+		if msg.ClientMessageID != "" {
+			if existing, findErr := s.ChatStorage.FindChatLogByClientMessageID(room.ID, msg.FromUserID, msg.ClientMessageID); findErr == nil {
+				return existing.Data(), true, nil
+			}
+		}
+		return saved, false, err
+	}
+	if parent != nil {
+		s.threadChanged(room, parent.ID)
+	} else {
+		s.cache.UpdateChatLogs(room.ID, chatLog)
+	}
+	return chatLog.Data(), false, nil
+}
+
+const (
+	defaultChatPageSize = 50
+	maxChatPageSize     = 100
+)
+
+var ErrPageSize = fmt.Errorf("page size must be between 1 and %d", maxChatPageSize)
+
+// ChatHistory pages through the saved messages in a visitor's room that they can see.
+// HasMore says whether there are more in the direction of the query.
+func (s *ChatRoomsService) ChatHistory(visitor *Visitor, before, after uint, limit int) (types.ChatHistoryData, error) {
+	if before != 0 && after != 0 {
+		return types.ChatHistoryData{}, errors.New("page before or after a message, not both")
+	}
+	if limit < 0 || limit > maxChatPageSize {
+		return types.ChatHistoryData{}, ErrPageSize
+	}
+	if limit == 0 {
+		limit = defaultChatPageSize
+	}
+
+	chatLogs, err := s.ChatStorage.GetChatLogPage(visitor.Room.ID, visitor.User.ID, before, after, limit+1)
+	if err != nil {
+		return types.ChatHistoryData{}, err
+	}
+	page := types.ChatHistoryData{Messages: []types.UserMessageData{}, Before: before, After: after}
+	if len(chatLogs) > limit {
+		page.HasMore = true
+		if after != 0 {
+			chatLogs = chatLogs[:limit]
+		} else {
+			chatLogs = chatLogs[1:]
+		}
+	}
+	for _, chatLog := range chatLogs {
+		page.Messages = append(page.Messages, chatLog.Data())
+	}
+	if len(chatLogs) > 0 {
+		page.Before = chatLogs[0].ID
+		page.After = chatLogs[len(chatLogs)-1].ID
+	}
+	return page, nil
 }
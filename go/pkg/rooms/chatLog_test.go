@@ -0,0 +1,129 @@
+package rooms
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+// joinChat signs a new user into a room and returns their visitor
+func (s *testService) joinChat(t *testing.T, room *ChatRoom) *Visitor {
+	t.Helper()
+	visitor := NewVisitor(newTestClient(t), nil, room)
+	if err := room.AddVisitor(visitor, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.AddUser(s.createUser(t)); err != nil {
+		t.Fatal(err)
+	}
+	return visitor
+}
+
+func (s *testService) say(t *testing.T, visitor *Visitor, text string, to uint) types.UserMessageData {
+	t.Helper()
+	saved, _, err := s.SaveChatLog(types.UserMessageData{Text: text, FromUserID: visitor.User.ID, FromUserName: visitor.User.Name, ToUserID: to}, visitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return saved
+}
+
+func texts(messages []types.UserMessageData) []string {
+	found := []string{}
+	for _, message := range messages {
+		found = append(found, message.Text)
+	}
+	return found
+}
+
+func TestChatHistoryPages(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	visitor := s.joinChat(t, room)
+
+	ids := []uint{}
+	for i := 0; i < 5; i++ {
+		ids = append(ids, s.say(t, visitor, fmt.Sprint(i), 0).ID)
+	}
+
+	page, err := s.ChatHistory(visitor, 0, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(texts(page.Messages)); got != "[3 4]" || !page.HasMore {
+		t.Errorf("latest page is %s, has more %v", got, page.HasMore)
+	}
+
+	page, err = s.ChatHistory(visitor, page.Before, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(texts(page.Messages)); got != "[1 2]" || !page.HasMore {
+		t.Errorf("page before is %s, has more %v", got, page.HasMore)
+	}
+
+	page, err = s.ChatHistory(visitor, page.Before, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(texts(page.Messages)); got != "[0]" || page.HasMore {
+		t.Errorf("first page is %s, has more %v", got, page.HasMore)
+	}
+
+	page, err = s.ChatHistory(visitor, 0, ids[1], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(texts(page.Messages)); got != "[2 3]" || !page.HasMore {
+		t.Errorf("page after is %s, has more %v", got, page.HasMore)
+	}
+
+	if _, err := s.ChatHistory(visitor, ids[3], ids[1], 2); err == nil {
+		t.Error("paged before and after a message at once")
+	}
+	if _, err := s.ChatHistory(visitor, 0, 0, maxChatPageSize+1); err != ErrPageSize {
+		t.Errorf("oversized page: %v", err)
+	}
+}
+
+// TestChatHistoryDirectMessages keeps direct messages, edited or not, between the two people they concern
+func TestChatHistoryDirectMessages(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	alice, bob, carol := s.joinChat(t, room), s.joinChat(t, room), s.joinChat(t, room)
+
+	s.say(t, alice, "hello all", 0)
+	secret := s.say(t, alice, "psst", bob.User.ID)
+	if _, err := s.EditMessage(alice, secret.ID, "psst, edited"); err != nil {
+		t.Fatal(err)
+	}
+	s.say(t, bob, "bye all", 0)
+
+	want := map[*Visitor]string{
+		alice: "[hello all psst, edited bye all]",
+		bob:   "[hello all psst, edited bye all]",
+		carol: "[hello all bye all]",
+	}
+	for visitor, want := range want {
+		page, err := s.ChatHistory(visitor, 0, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(texts(page.Messages)); got != want {
+			t.Errorf("user %d's history is %s, want %s", visitor.User.ID, got, want)
+		}
+		if got := fmt.Sprint(texts(room.JoinedRoomData(visitor.User).ChatLog)); got != want {
+			t.Errorf("user %d joined to %s, want %s", visitor.User.ID, got, want)
+		}
+	}
+
+	if got := fmt.Sprint(texts(room.JoinedRoomData(nil).ChatLog)); got != "[hello all bye all]" {
+		t.Errorf("anonymous visitor joined to %s", got)
+	}
+	if _, err := s.EditMessage(carol, secret.ID, "mine now"); err == nil {
+		t.Error("a third user edited someone else's direct message")
+	}
+}
@@ -2,11 +2,22 @@ package rooms
 
 import (
 	"github.com/Embiggenerd/spiritio/pkg/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type ChatLogStore interface {
 	SaveChatlog(chatLog *ChatRoomLog) (*ChatRoomLog, error)
-	GetChatLogsByRoomID(roomID uint) ([]ChatRoomLog, error)
+	GetChatLogPage(roomID, userID, before, after uint, limit int) ([]ChatRoomLog, error)
+	GetChatLogWindow(roomID uint, limit int) ([]ChatRoomLog, error)
+	FindChatLogByClientMessageID(roomID, fromUserID uint, clientMessageID string) (*ChatRoomLog, error)
+	LastSeq(roomID uint) (uint64, error)
+	BackfillSeqs() error
+	FindChatLog(roomID, id uint) (*ChatRoomLog, error)
+	EditChatLog(chatLog *ChatRoomLog, previous *ChatLogEdit) error
+	DeleteChatLog(chatLog *ChatRoomLog) error
+	GetRepliesPage(parentID, after uint, limit int) ([]ChatRoomLog, error)
+	UpdateThreadSummary(parentID uint) (*ChatRoomLog, error)
 }
 
 type ChatLogStorage struct {
@@ -18,11 +29,111 @@ func (s *ChatLogStorage) SaveChatlog(chatLog *ChatRoomLog) (*ChatRoomLog, error)
 	return chatLog, result.Error
 }
 
-func (s *ChatLogStorage) GetChatLogsByRoomID(roomID uint) ([]ChatRoomLog, error) {
-	var err error
+// GetChatLogPage finds up to limit messages in a room's main timeline that a user can see, oldest first. With after
+// set they are the first messages after that id, otherwise the last ones before before, or the last ones of all.
+func (s *ChatLogStorage) GetChatLogPage(roomID, userID, before, after uint, limit int) ([]ChatRoomLog, error) {
+	tx := s.db.DB.Where("to_user_id = 0 OR to_user_id = ? OR from_user_id = ?", userID, userID)
+	return chatLogPage(tx, roomID, before, after, limit)
+}
+
+// GetChatLogWindow finds the last limit messages in a room's main timeline, direct messages included, oldest first.
+// It fills the room's cache, which is filtered for each visitor.
+func (s *ChatLogStorage) GetChatLogWindow(roomID uint, limit int) ([]ChatRoomLog, error) {
+	return chatLogPage(s.db.DB, roomID, 0, 0, limit)
+}
+
+func chatLogPage(tx *gorm.DB, roomID, before, after uint, limit int) ([]ChatRoomLog, error) {
 	chatLogs := []ChatRoomLog{}
+	tx = tx.Preload("Reactions", orderByID).Where("room_id = ? AND parent_id IS NULL", roomID).Limit(limit)
+
+	if after != 0 {
+		result := tx.Where("id > ?", after).Order("id").Find(&chatLogs)
+		return chatLogs, result.Error
+	}
+
+	if before != 0 {
+		tx = tx.Where("id < ?", before)
+	}
+	result := tx.Order("id DESC").Find(&chatLogs)
+	for i, j := 0, len(chatLogs)-1; i < j; i, j = i+1, j-1 {
+		chatLogs[i], chatLogs[j] = chatLogs[j], chatLogs[i]
+	}
+	return chatLogs, result.Error
+}
+
+func (s *ChatLogStorage) FindChatLogByClientMessageID(roomID, fromUserID uint, clientMessageID string) (*ChatRoomLog, error) {
+	chatLog := &ChatRoomLog{}
+	// Deleted messages are included, so retrying one does not send it again
+	result := s.db.DB.Unscoped().Preload("Reactions", orderByID).Where("room_id = ? AND from_user_id = ? AND client_message_id = ?", roomID, fromUserID, clientMessageID).First(chatLog)
+	return chatLog, result.Error
+}
+
+// LastSeq finds the sequence number of a room's latest message, or zero if it has none
+func (s *ChatLogStorage) LastSeq(roomID uint) (uint64, error) {
+	var seq uint64
+	result := s.db.DB.Unscoped().Model(&ChatRoomLog{}).Where("room_id = ?", roomID).Select("COALESCE(MAX(seq), 0)").Scan(&seq)
+	return seq, result.Error
+}
+
+// BackfillSeqs numbers messages saved before they had sequence numbers, in the order they were saved
+func (s *ChatLogStorage) BackfillSeqs() error {
+	result := s.db.DB.Exec(`UPDATE chat_room_logs SET seq = (
+		SELECT COUNT(*) FROM chat_room_logs AS earlier
+		WHERE earlier.room_id = chat_room_logs.room_id AND earlier.id <= chat_room_logs.id
+	) WHERE seq = 0 OR seq IS NULL`)
+	return result.Error
+}
 
-	result := s.db.DB.Where(ChatRoomLog{RoomID: roomID}).Find(&chatLogs)
-	err = result.Error
-	return chatLogs, err
+func (s *ChatLogStorage) FindChatLog(roomID, id uint) (*ChatRoomLog, error) {
+	chatLog := &ChatRoomLog{}
+	result := s.db.DB.Preload("Reactions", orderByID).Where("room_id = ?", roomID).First(chatLog, id)
+	return chatLog, result.Error
+}
+
+// EditChatLog saves a message's new text along with the text it replaced
+func (s *ChatLogStorage) EditChatLog(chatLog *ChatRoomLog, previous *ChatLogEdit) error {
+	return s.db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(previous).Error; err != nil {
+			return err
+		}
+		return tx.Model(chatLog).Omit(clause.Associations).Select("text", "edited_at").Updates(chatLog).Error
+	})
+}
+
+// DeleteChatLog soft deletes a message. Its edit history is kept with it.
+func (s *ChatLogStorage) DeleteChatLog(chatLog *ChatRoomLog) error {
+	if err := s.db.DB.Delete(chatLog).Error; err != nil {
+		return err
+	}
+	return s.db.DB.Unscoped().First(chatLog, chatLog.ID).Error
+}
+
+// orderByID keeps preloaded rows in the order they were created
+func orderByID(db *gorm.DB) *gorm.DB {
+	return db.Order("id")
+}
+
+// GetRepliesPage finds up to limit replies to a message, oldest first, after the after id
+func (s *ChatLogStorage) GetRepliesPage(parentID, after uint, limit int) ([]ChatRoomLog, error) {
+	chatLogs := []ChatRoomLog{}
+	result := s.db.DB.Preload("Reactions", orderByID).
+		Where("parent_id = ? AND id > ?", parentID, after).
+		Order("id").
+		Limit(limit).
+		Find(&chatLogs)
+	return chatLogs, result.Error
+}
+
+// UpdateThreadSummary recounts a message's replies that have not been deleted, and returns the message
+func (s *ChatLogStorage) UpdateThreadSummary(parentID uint) (*ChatRoomLog, error) {
+	result := s.db.DB.Exec(`UPDATE chat_room_logs SET
+		reply_count = (SELECT COUNT(*) FROM chat_room_logs AS replies WHERE replies.parent_id = chat_room_logs.id AND replies.deleted_at IS NULL),
+		last_reply_at = (SELECT MAX(created_at) FROM chat_room_logs AS replies WHERE replies.parent_id = chat_room_logs.id AND replies.deleted_at IS NULL)
+	WHERE id = ?`, parentID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	chatLog := &ChatRoomLog{}
+	result = s.db.DB.Unscoped().Preload("Reactions", orderByID).First(chatLog, parentID)
+	return chatLog, result.Error
 }
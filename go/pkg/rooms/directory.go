@@ -0,0 +1,67 @@
+package rooms
+
+import (
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+// OnOccupancyChanged registers a hook that runs whenever visitors come and go from a room,
+// its media starts or stops, or its metadata changes
+func (s *ChatRoomsService) OnOccupancyChanged(hook RoomHook) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.occupancyHooks = append(s.occupancyHooks, hook)
+}
+
+// OccupancyChanged runs the service's occupancy hooks. It must not be called from the room's goroutine.
+func (r *ChatRoom) OccupancyChanged() {
+	if r.Service != nil {
+		r.Service.runHooks(r.Service.occupancyHooks, r)
+	}
+}
+
+// VisitorCount returns the number of visitors in the room, not counting the lobby
+func (r *ChatRoom) VisitorCount() int {
+	count := 0
+	r.do(func() {
+		count = len(r.visitors)
+	})
+	return count
+}
+
+// DirectoryEntry describes a room in the public directory
+func (s *ChatRoomsService) DirectoryEntry(room *ChatRoom) types.DirectoryRoomData {
+	metadata := room.Metadata()
+	return types.DirectoryRoomData{
+		Slug:     metadata.Slug,
+		Name:     metadata.Name,
+		Topic:    metadata.Topic,
+		Private:  metadata.PasscodeHash != "" || metadata.Settings.InviteOnly,
+		Visitors: room.VisitorCount(),
+		Live:     len(room.SFU.Tracks()) > 0,
+	}
+}
+
+// Directory lists public rooms whose slug, name or topic contains query.
+// Rooms that are open take their occupancy from the cache, the rest are empty.
+func (s *ChatRoomsService) Directory(query string) ([]types.DirectoryRoomData, error) {
+	stored, err := s.RoomStorage.FindPublicRooms(query)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []types.DirectoryRoomData{}
+	for i := range stored {
+		if room, err := s.cache.GetRoom(stored[i].ID); err == nil {
+			entries = append(entries, s.DirectoryEntry(room))
+			continue
+		}
+		metadata := stored[i].RoomMetadata
+		entries = append(entries, types.DirectoryRoomData{
+			Slug:    metadata.Slug,
+			Name:    metadata.Name,
+			Topic:   metadata.Topic,
+			Private: metadata.PasscodeHash != "" || metadata.Settings.InviteOnly,
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,6 @@
+//go:build sqlite_fts5
+
+package rooms
+
+// fts5Built says whether the sqlite driver was built with FTS5, which message search needs
+const fts5Built = true
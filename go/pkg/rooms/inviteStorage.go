@@ -0,0 +1,78 @@
+package rooms
+
+import (
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"gorm.io/gorm"
+)
+
+type InviteStore interface {
+	SaveInvite(invite *RoomInvite) error
+	FindInvite(inviteID string, roomID uint) (*RoomInvite, error)
+	InviteUsable(inviteID string, roomID, userID uint) (bool, error)
+	UseInvite(inviteID string, roomID, userID uint) (bool, error)
+}
+
+type InviteStorage struct {
+	db *db.Database
+}
+
+func (s *InviteStorage) SaveInvite(invite *RoomInvite) error {
+	result := s.db.DB.Create(invite)
+	return result.Error
+}
+
+func (s *InviteStorage) FindInvite(inviteID string, roomID uint) (*RoomInvite, error) {
+	invite := &RoomInvite{}
+	result := s.db.DB.Where("id = ? AND room_id = ?", inviteID, roomID).First(invite)
+	return invite, result.Error
+}
+
+// InviteUsable reports whether an invite has not expired, and either has uses left or was already used by the user
+func (s *InviteStorage) InviteUsable(inviteID string, roomID, userID uint) (bool, error) {
+	var count int64
+	result := s.db.DB.Model(&RoomInvite{}).
+		Where("id = ? AND room_id = ? AND expires_at > ?", inviteID, roomID, time.Now()).
+		Where("max_uses = 0 OR uses < max_uses OR EXISTS (SELECT 1 FROM room_invite_uses WHERE invite_id = ? AND user_id = ? AND user_id != 0)", inviteID, userID).
+		Count(&count)
+	return count == 1, result.Error
+}
+
+// UseInvite counts a use of an invite, reporting false if it has expired or been used up.
+// A user who used it before is let through without counting again. Checking and counting
+// happen in one transaction so that concurrent joins can't overspend it.
+func (s *InviteStorage) UseInvite(inviteID string, roomID, userID uint) (bool, error) {
+	used := false
+	err := s.db.DB.Transaction(func(tx *gorm.DB) error {
+		if userID != 0 {
+			var count int64
+			result := tx.Model(&RoomInviteUse{}).
+				Joins("JOIN room_invites ON room_invites.id = room_invite_uses.invite_id").
+				Where("room_invite_uses.invite_id = ? AND room_invite_uses.user_id = ?", inviteID, userID).
+				Where("room_invites.room_id = ? AND room_invites.expires_at > ?", roomID, time.Now()).
+				Count(&count)
+			if result.Error != nil {
+				return result.Error
+			}
+			if count > 0 {
+				used = true
+				return nil
+			}
+		}
+
+		result := tx.Model(&RoomInvite{}).
+			Where("id = ? AND room_id = ? AND expires_at > ?", inviteID, roomID, time.Now()).
+			Where("max_uses = 0 OR uses < max_uses").
+			Update("uses", gorm.Expr("uses + 1"))
+		if result.Error != nil || result.RowsAffected != 1 {
+			return result.Error
+		}
+		used = true
+		if userID == 0 {
+			return nil
+		}
+		return tx.Create(&RoomInviteUse{InviteID: inviteID, UserID: userID}).Error
+	})
+	return used, err
+}
@@ -0,0 +1,225 @@
+package rooms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/types"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAccessDenied  = errors.New("this room needs a passcode or an invite")
+	ErrInviteInvalid = errors.New("invite is not valid")
+)
+
+const (
+	inviteAudience      = "room_invite"
+	defaultInviteExpiry = 24 * time.Hour
+)
+
+// RoomInvite records an invite token so its uses can be counted
+type RoomInvite struct {
+	ID          string `gorm:"primaryKey"`
+	RoomID      uint   `gorm:"index"`
+	CreatedByID uint
+	Role        Role
+	// MaxUses caps how many times the invite can be used, zero means no cap
+	MaxUses   int
+	Uses      int
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// RoomInviteUse records who has used an invite, so using it again doesn't count against its uses
+type RoomInviteUse struct {
+	InviteID  string `gorm:"primaryKey"`
+	UserID    uint   `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+// InviteClaims are signed into invite tokens with a key derived from the server secret
+type InviteClaims struct {
+	RoomID uint
+	Role   Role
+	jwt.RegisteredClaims
+}
+
+// CreateInvite signs an invite token for a room. A zero expiresIn means a day.
+func (s *ChatRoomsService) CreateInvite(room *ChatRoom, createdByID uint, role Role, expiresIn time.Duration, maxUses int) (string, *RoomInvite, error) {
+	if expiresIn < 0 || maxUses < 0 {
+		return "", nil, errors.New("expiry and max uses can not be negative")
+	}
+	if role == RoleOwner {
+		return "", nil, ErrOwnerRole
+	}
+	if expiresIn == 0 {
+		expiresIn = defaultInviteExpiry
+	}
+
+	now := time.Now()
+	invite := &RoomInvite{
+		ID:          uuid.NewString(),
+		RoomID:      room.ID,
+		CreatedByID: createdByID,
+		Role:        role,
+		MaxUses:     maxUses,
+		ExpiresAt:   now.Add(expiresIn),
+		CreatedAt:   now,
+	}
+	token, err := s.signInvite(invite)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := s.InviteStorage.SaveInvite(invite); err != nil {
+		return "", nil, err
+	}
+	return token, invite, nil
+}
+
+// signInvite makes the token for an invite. The same invite always gets the same token.
+func (s *ChatRoomsService) signInvite(invite *RoomInvite) (string, error) {
+	claims := InviteClaims{
+		invite.RoomID,
+		invite.Role,
+		jwt.RegisteredClaims{
+			ID:        invite.ID,
+			Audience:  jwt.ClaimStrings{inviteAudience},
+			ExpiresAt: jwt.NewNumericDate(invite.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(invite.CreatedAt),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.inviteKey())
+}
+
+// CalendarInvite returns the member invite in a room's calendar file. Each schedule gets one, with no
+// cap on its uses, which every download of the file shares so that downloads don't mint new invites.
+func (s *ChatRoomsService) CalendarInvite(room *ChatRoom, createdByID uint, expiresIn time.Duration) (string, error) {
+	schedule := room.Metadata().Schedule
+	if schedule.InviteID != "" {
+		invite, err := s.InviteStorage.FindInvite(schedule.InviteID, room.ID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", err
+		}
+		if err == nil && invite.ExpiresAt.After(time.Now()) {
+			return s.signInvite(invite)
+		}
+	}
+
+	token, invite, err := s.CreateInvite(room, createdByID, RoleMember, expiresIn, 0)
+	if err != nil {
+		return "", err
+	}
+	var metadata RoomMetadata
+	changed := false
+	room.do(func() {
+		// The schedule may have been replaced meanwhile, in which case its own invite is made when asked for
+		if room.Schedule.InviteID == schedule.InviteID {
+			room.Schedule.InviteID = invite.ID
+			metadata = room.RoomMetadata
+			changed = true
+		}
+	})
+	if changed {
+		if err := s.RoomStorage.UpdateRoomMetadata(room.ID, metadata); err != nil {
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+// inviteKey signs invites. It is derived from the server secret rather than being the secret itself,
+// so an invite can never pass for an access token.
+func (s *ChatRoomsService) inviteKey() []byte {
+	mac := hmac.New(sha256.New, []byte(s.cfg.AccessTokenSecret))
+	mac.Write([]byte(inviteAudience))
+	return mac.Sum(nil)
+}
+
+// CheckAccess decides whether a visitor may join a room. userID is who they are, if they said.
+// An invite is only checked here, RedeemInvite uses it once we know who is using it.
+// Without one, private rooms need their passcode.
+func (s *ChatRoomsService) CheckAccess(room *ChatRoom, passcode, invite string, userID uint) error {
+	if invite != "" {
+		claims, err := s.parseInvite(room, invite)
+		if err != nil {
+			return err
+		}
+		usable, err := s.InviteStorage.InviteUsable(claims.ID, room.ID, userID)
+		if err != nil {
+			return err
+		}
+		if !usable {
+			return ErrInviteInvalid
+		}
+		return nil
+	}
+
+	metadata := room.Metadata()
+	if metadata.PasscodeHash == "" && !metadata.Settings.InviteOnly {
+		return nil
+	}
+	if metadata.PasscodeHash != "" && passcode != "" {
+		if bcrypt.CompareHashAndPassword([]byte(metadata.PasscodeHash), []byte(passcode)) == nil {
+			return nil
+		}
+	}
+	return ErrAccessDenied
+}
+
+// RedeemInvite uses an invite on behalf of a user, returning the role it grants. Someone who already
+// used it can use it again for free, so reconnecting doesn't use invites up. Anonymous users, with a
+// zero id, can't be told apart, so each of their sessions counts as a use.
+func (s *ChatRoomsService) RedeemInvite(room *ChatRoom, invite string, userID uint) (Role, error) {
+	claims, err := s.parseInvite(room, invite)
+	if err != nil {
+		return "", err
+	}
+	used, err := s.InviteStorage.UseInvite(claims.ID, room.ID, userID)
+	if err != nil {
+		return "", err
+	}
+	if !used {
+		return "", ErrInviteInvalid
+	}
+	return claims.Role, nil
+}
+
+// parseInvite validates an invite token's signature, and that it was made for this room
+func (s *ChatRoomsService) parseInvite(room *ChatRoom, tokenString string) (*InviteClaims, error) {
+	claims := &InviteClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.inviteKey(), nil
+	})
+	if err != nil || !token.Valid || !claims.VerifyAudience(inviteAudience, true) || claims.RoomID != room.ID {
+		return nil, ErrInviteInvalid
+	}
+	return claims, nil
+}
+
+// grantRole gives a user the role their invite carried, unless they already rank higher
+func (s *ChatRoomsService) grantRole(room *ChatRoom, user *users.User, role Role) {
+	var current Role
+	room.do(func() {
+		current = room.roleOf(user)
+	})
+	if roleRanks[role] <= roleRanks[current] {
+		return
+	}
+	if err := s.SetRole(room, user.ID, role); err != nil {
+		s.log.Error(err.Error())
+		return
+	}
+	room.BroadcastEvent(&types.Event{Event: "roles_updated", Data: room.Roles()})
+}
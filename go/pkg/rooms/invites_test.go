@@ -0,0 +1,102 @@
+package rooms
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInviteIsNotAnAccessToken(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+
+	token, _, err := s.CreateInvite(room, s.createUser(t).ID, RoleMember, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.users.ValidateAccessToken(token); err == nil {
+		t.Error("invite was accepted as an access token")
+	}
+
+	_, accessToken, err := s.users.CreateUser(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckAccess(room, "", accessToken, 0); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("access token was accepted as an invite: %v", err)
+	}
+}
+
+func TestRedeemInvite(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	other := s.createRoom(t)
+	defer s.CloseRoom(other, "test over")
+
+	token, _, err := s.CreateInvite(room, s.createUser(t).ID, RoleModerator, time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := s.createUser(t)
+	second := s.createUser(t)
+
+	if err := s.CheckAccess(other, "", token, first.ID); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("invite let someone into another room: %v", err)
+	}
+	if err := s.CheckAccess(room, "", token, 0); err != nil {
+		t.Fatalf("unused invite was refused: %v", err)
+	}
+	// Checking an invite doesn't use it
+	if err := s.CheckAccess(room, "", token, second.ID); err != nil {
+		t.Fatalf("unused invite was refused: %v", err)
+	}
+
+	role, err := s.RedeemInvite(room, token, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != RoleModerator {
+		t.Errorf("invite granted %s, want %s", role, RoleModerator)
+	}
+
+	// Reconnecting doesn't use it again
+	if err := s.CheckAccess(room, "", token, first.ID); err != nil {
+		t.Errorf("invite was refused to the user who used it: %v", err)
+	}
+	if _, err := s.RedeemInvite(room, token, first.ID); err != nil {
+		t.Errorf("invite was refused to the user who used it: %v", err)
+	}
+
+	if err := s.CheckAccess(room, "", token, second.ID); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("used up invite let someone else in: %v", err)
+	}
+	if _, err := s.RedeemInvite(room, token, second.ID); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("used up invite was redeemed by someone else: %v", err)
+	}
+	if _, err := s.RedeemInvite(room, token, 0); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("used up invite was redeemed anonymously: %v", err)
+	}
+}
+
+func TestRedeemExpiredInvite(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	user := s.createUser(t)
+
+	token, invite, err := s.CreateInvite(room, user.ID, RoleMember, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RedeemInvite(room, token, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DB.DB.Model(invite).Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RedeemInvite(room, token, user.ID); !errors.Is(err, ErrInviteInvalid) {
+		t.Errorf("expired invite was redeemed again: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package rooms
+
+import (
+	"context"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/utils"
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+const (
+	RoomClosedIdle = "idle"
+)
+
+// RoomHook is called when a room is loaded into or evicted from the cache
+type RoomHook func(room *ChatRoom)
+
+// Touch records activity in the room, pushing back idle eviction
+func (r *ChatRoom) Touch() {
+	r.do(func() {
+		r.LastActiveAt = time.Now()
+	})
+}
+
+// IdleFor reports how long the room has gone without visitors or media, or zero if it is in use
+func (r *ChatRoom) IdleFor() time.Duration {
+	var idle time.Duration
+	r.do(func() {
+		// A room whose visitors are all off in breakouts is still in use
+		if len(r.visitors) == 0 && len(r.lobby) == 0 && len(r.breakouts) == 0 {
+			idle = time.Since(r.LastActiveAt)
+		}
+	})
+	if !r.SFU.Idle() {
+		return 0
+	}
+	return idle
+}
+
+// Close tells anyone still connected why the room is going away, then stops its goroutines and SFU
+// and closes their sockets, so that nobody is left talking to a room that no longer answers
+func (r *ChatRoom) Close(reason string) {
+	r.closeOnce.Do(func() {
+		var remaining, waiting []*Visitor
+		r.do(func() {
+			// Visitors who have not signed in yet are told too, since they are about to be cut off
+			event := &types.Event{Event: "room_closed", Data: types.RoomClosedData{
+				RoomID: r.ID,
+				Reason: reason,
+			}}
+			for _, v := range r.visitors {
+				v.Notify(event)
+			}
+			for _, v := range r.lobby {
+				v.Notify(event)
+			}
+			remaining = r.visitors
+			waiting = r.lobby
+			r.closed = true
+			close(r.done)
+		})
+		r.SFU.Close()
+
+		// Nobody can leave a closed room, so their sessions end here
+		for _, v := range remaining {
+			if r.Service != nil {
+				r.Service.endAttendance(r, v)
+			}
+		}
+		for _, v := range append(remaining, waiting...) {
+			if v.Client != nil {
+				v.Client.Close()
+			}
+		}
+	})
+}
+
+// every runs f on an interval until the room is closed
+func (r *ChatRoom) every(interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
+}
+
+// OnRoomOpened registers a hook that runs whenever a room is loaded into the cache
+func (s *ChatRoomsService) OnRoomOpened(hook RoomHook) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.openedHooks = append(s.openedHooks, hook)
+}
+
+// OnRoomClosed registers a hook that runs whenever a room is evicted from the cache
+func (s *ChatRoomsService) OnRoomClosed(hook RoomHook) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.closedHooks = append(s.closedHooks, hook)
+}
+
+func (s *ChatRoomsService) runHooks(hooks []RoomHook, room *ChatRoom) {
+	s.hooksMu.Lock()
+	hooks = append([]RoomHook{}, hooks...)
+	s.hooksMu.Unlock()
+
+	for _, hook := range hooks {
+		hook(room)
+	}
+}
+
+// CloseRoom evicts a room from the cache, tears it down and flushes its state to the database
+func (s *ChatRoomsService) CloseRoom(room *ChatRoom, reason string) {
+	s.cache.RemoveRoom(room.ID)
+	room.Close(reason)
+
+	if err := s.RoomStorage.UpdateRoomActivity(room.ID, room.LastActiveAt); err != nil {
+		s.log.Error(err.Error())
+	}
+	s.runHooks(s.closedHooks, room)
+	s.log.Info("room " + utils.UintToString(room.ID) + " closed: " + reason)
+}
+
+// evictIdleRooms closes rooms that have had no visitors for longer than RoomIdleTimeout. A timeout of 0 turns it off.
+func (s *ChatRoomsService) evictIdleRooms(ctx context.Context) {
+	timeout := time.Duration(s.cfg.RoomIdleTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, room := range s.cache.Rooms() {
+			if room.IdleFor() > timeout {
+				s.CloseRoom(room, RoomClosedIdle)
+			}
+		}
+	}
+}
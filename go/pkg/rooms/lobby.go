@@ -0,0 +1,173 @@
+package rooms
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+var ErrNotInLobby = errors.New("user is not waiting in the lobby")
+
+// RoomAdmission remembers that a registered user was let into a room, so they can skip its lobby next time
+type RoomAdmission struct {
+	ID        uint `gorm:"primaryKey"`
+	RoomID    uint `gorm:"uniqueIndex:idx_admission_room_user"`
+	UserID    uint `gorm:"uniqueIndex:idx_admission_room_user"`
+	CreatedAt time.Time
+}
+
+// InLobby reports whether the visitor is still waiting to be admitted
+func (v *Visitor) InLobby() bool {
+	waiting := false
+	v.Room.WithVisitor(v, func(v *Visitor) {
+		waiting = v.Waiting
+	})
+	return waiting
+}
+
+// Lobby lists the signed in visitors waiting to be admitted
+func (r *ChatRoom) Lobby() []types.Visitor {
+	waiting := []types.Visitor{}
+	r.do(func() {
+		for _, v := range r.lobby {
+			if v.User != nil {
+				waiting = append(waiting, types.Visitor{ID: v.User.ID, Name: v.User.Name})
+			}
+		}
+	})
+	return waiting
+}
+
+// Admit moves every connection a user has waiting in the lobby into the room and sends them joined_room.
+// It returns a copy of the user, or nil if they were not waiting.
+func (r *ChatRoom) Admit(userID uint) *users.User {
+	var admitted *users.User
+	var entered []*Visitor
+	r.do(func() {
+		entered = r.admitWhere(func(v *Visitor) bool {
+			if v.User == nil || v.User.ID != userID {
+				return false
+			}
+			user := *v.User
+			admitted = &user
+			return true
+		})
+	})
+	if len(entered) > 0 {
+		r.admitted(entered)
+	}
+	return admitted
+}
+
+// AdmitAll empties the lobby into the room
+func (r *ChatRoom) AdmitAll() {
+	var entered []*Visitor
+	r.do(func() {
+		entered = r.admitWhere(func(v *Visitor) bool { return true })
+	})
+	if len(entered) > 0 {
+		r.admitted(entered)
+	}
+}
+
+// admitted starts the attendance of visitors let in from the lobby
+func (r *ChatRoom) admitted(entered []*Visitor) {
+	for _, v := range entered {
+		if r.Service != nil {
+			r.Service.startAttendance(r, v)
+		}
+	}
+	r.OccupancyChanged()
+}
+
+// Deny takes every connection a user has waiting in the lobby out of it, telling each.
+// It returns the denied visitors so their sockets can be closed.
+func (r *ChatRoom) Deny(userID uint) []*Visitor {
+	denied := []*Visitor{}
+	r.do(func() {
+		waiting := []*Visitor{}
+		for _, v := range r.lobby {
+			if v.User == nil || v.User.ID != userID {
+				waiting = append(waiting, v)
+				continue
+			}
+			v.Waiting = false
+			v.Notify(&types.Event{Event: "lobby_denied", Data: r.ID})
+			denied = append(denied, v)
+		}
+		r.lobby = waiting
+	})
+	return denied
+}
+
+// admitWhere admits the waiting visitors that match, returning them. Those who have not signed in
+// yet are shown the room when they do. It must run on the room's goroutine.
+func (r *ChatRoom) admitWhere(match func(v *Visitor) bool) []*Visitor {
+	admitted := []*Visitor{}
+	waiting := []*Visitor{}
+	for _, v := range r.lobby {
+		if !match(v) {
+			waiting = append(waiting, v)
+			continue
+		}
+		v.Waiting = false
+		r.visitors = append(r.visitors, v)
+		if v.User != nil {
+			v.Notify(&types.Event{Event: "joined_room", Data: r.joinedRoomData(v.User)})
+		}
+		admitted = append(admitted, v)
+	}
+	r.lobby = waiting
+	r.LastActiveAt = time.Now()
+	return admitted
+}
+
+// skipsLobby reports whether a user goes straight in: hosts, and registered users who were admitted before
+func (s *ChatRoomsService) skipsLobby(room *ChatRoom, user *users.User) bool {
+	canAdmit := false
+	room.do(func() {
+		canAdmit = room.can(user, PermAdmit)
+	})
+	if canAdmit {
+		return true
+	}
+	if user.Password == "" {
+		return false
+	}
+	admitted, err := s.LobbyStorage.IsAdmitted(room.ID, user.ID)
+	if err != nil {
+		s.log.Error(err.Error())
+	}
+	return admitted
+}
+
+// enterLobby runs when a waiting visitor signs in. They are either let straight in,
+// or the room's hosts are asked to admit them.
+func (s *ChatRoomsService) enterLobby(room *ChatRoom, user *users.User) {
+	// Before the meeting starts only hosts get in. Everyone else is let through when it does.
+	if _, held := room.NotStarted(); held && !room.Allows(user, PermAdmit) {
+		return
+	}
+	if s.skipsLobby(room, user) {
+		room.Admit(user.ID)
+		return
+	}
+	room.NotifyPermitted(PermAdmit, &types.Event{Event: "lobby_join_request", Data: types.Visitor{
+		ID:   user.ID,
+		Name: user.Name,
+	}})
+}
+
+// AdmitUser lets a user waiting in the lobby into the room. Registered users are remembered so they can skip it next time.
+func (s *ChatRoomsService) AdmitUser(room *ChatRoom, userID uint) (*users.User, error) {
+	user := room.Admit(userID)
+	if user == nil {
+		return nil, ErrNotInLobby
+	}
+	if user.Password == "" {
+		return user, nil
+	}
+	return user, s.LobbyStorage.SaveAdmission(&RoomAdmission{RoomID: room.ID, UserID: user.ID})
+}
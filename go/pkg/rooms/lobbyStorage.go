@@ -0,0 +1,26 @@
+package rooms
+
+import (
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"gorm.io/gorm/clause"
+)
+
+type LobbyStore interface {
+	SaveAdmission(admission *RoomAdmission) error
+	IsAdmitted(roomID, userID uint) (bool, error)
+}
+
+type LobbyStorage struct {
+	db *db.Database
+}
+
+func (s *LobbyStorage) SaveAdmission(admission *RoomAdmission) error {
+	result := s.db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(admission)
+	return result.Error
+}
+
+func (s *LobbyStorage) IsAdmitted(roomID, userID uint) (bool, error) {
+	var count int64
+	result := s.db.DB.Model(&RoomAdmission{}).Where(RoomAdmission{RoomID: roomID, UserID: userID}).Count(&count)
+	return count > 0, result.Error
+}
@@ -0,0 +1,163 @@
+package rooms
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Embiggenerd/spiritio/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrRoomLocked = errors.New("room is locked")
+	ErrRoomFull   = errors.New("room is full")
+)
+
+// RoomMetadata describes a room and what its visitors may do there
+type RoomMetadata struct {
+	// Slug is the room's public name in URLs. Sequential IDs stay internal so rooms can't be enumerated.
+	Slug        string `gorm:"uniqueIndex"`
+	Name        string
+	Topic       string
+	OwnerID     uint
+	CreatedByID uint
+	// PasscodeHash is a bcrypt hash, empty when the room has no passcode
+	PasscodeHash string
+	Settings     RoomSettings `gorm:"embedded"`
+	Schedule     RoomSchedule `gorm:"embedded;embeddedPrefix:schedule_"`
+	// ParentID links a breakout room to the room it was split from
+	ParentID *uint `gorm:"index"`
+}
+
+type RoomSettings struct {
+	ChatEnabled  bool `gorm:"default:true"`
+	VideoEnabled bool `gorm:"default:true"`
+	// MaxSize caps the number of connected visitors, zero means no cap
+	MaxSize int
+	// Locked rooms turn away new visitors
+	Locked bool
+	// LobbyEnabled holds new visitors in a lobby until a host admits them
+	LobbyEnabled bool
+	// InviteOnly rooms can only be joined with an invite, or the passcode if there is one
+	InviteOnly bool
+	// Public rooms are listed in the room directory
+	Public bool
+}
+
+// Metadata returns a copy of the room's metadata
+func (r *ChatRoom) Metadata() RoomMetadata {
+	var m RoomMetadata
+	if !r.do(func() { m = r.RoomMetadata }) {
+		// The room's goroutine has stopped, so nothing can change it any more
+		m = r.RoomMetadata
+	}
+	return m
+}
+
+// SetMetadata replaces the room's metadata once it has been persisted
+func (r *ChatRoom) SetMetadata(m RoomMetadata) {
+	r.do(func() {
+		r.RoomMetadata = m
+	})
+}
+
+// claim makes user the room's owner if they created it and nobody has claimed it yet.
+// Rooms are created before the socket that asked for them has joined, so the
+// creator only becomes the owner once they sign in to it.
+func (r *ChatRoom) claim(userID uint) bool {
+	claimed := false
+	r.do(func() {
+		if r.OwnerID == 0 && r.CreatedByID != 0 && r.CreatedByID == userID {
+			r.OwnerID = userID
+			claimed = true
+		}
+	})
+	return claimed
+}
+
+// RoomData describes the room's metadata to clients
+func (r *ChatRoom) RoomData() types.RoomData {
+	var data types.RoomData
+	r.do(func() {
+		data = r.roomData()
+	})
+	return data
+}
+
+func (r *ChatRoom) roomData() types.RoomData {
+	return types.RoomData{
+		ID:          r.ID,
+		Slug:        r.Slug,
+		Name:        r.Name,
+		Topic:       r.Topic,
+		OwnerID:     r.OwnerID,
+		CreatedByID: r.CreatedByID,
+		Mode:        r.Mode,
+		Settings: types.RoomSettingsData{
+			ChatEnabled:  r.Settings.ChatEnabled,
+			VideoEnabled: r.Settings.VideoEnabled,
+			MaxSize:      r.Settings.MaxSize,
+			Locked:       r.Settings.Locked,
+			LobbyEnabled: r.Settings.LobbyEnabled,
+			InviteOnly:   r.Settings.InviteOnly,
+			HasPasscode:  r.PasscodeHash != "",
+			Public:       r.Settings.Public,
+		},
+		Schedule: r.Schedule.Data(),
+		ParentID: r.ParentID,
+	}
+}
+
+// apply copies the fields set in an update_room work order onto the metadata
+func (m *RoomMetadata) apply(update types.UpdateRoomWorkOrderDetail) error {
+	if update.Name != nil {
+		name := strings.TrimSpace(*update.Name)
+		if len(name) > 100 {
+			return errors.New("room name must be 100 characters or fewer")
+		}
+		m.Name = name
+	}
+	if update.Topic != nil {
+		topic := strings.TrimSpace(*update.Topic)
+		if len(topic) > 500 {
+			return errors.New("room topic must be 500 characters or fewer")
+		}
+		m.Topic = topic
+	}
+	if update.ChatEnabled != nil {
+		m.Settings.ChatEnabled = *update.ChatEnabled
+	}
+	if update.VideoEnabled != nil {
+		m.Settings.VideoEnabled = *update.VideoEnabled
+	}
+	if update.MaxSize != nil {
+		if *update.MaxSize < 0 {
+			return errors.New("max size can not be negative")
+		}
+		m.Settings.MaxSize = *update.MaxSize
+	}
+	if update.Locked != nil {
+		m.Settings.Locked = *update.Locked
+	}
+	if update.LobbyEnabled != nil {
+		m.Settings.LobbyEnabled = *update.LobbyEnabled
+	}
+	if update.InviteOnly != nil {
+		m.Settings.InviteOnly = *update.InviteOnly
+	}
+	if update.Public != nil {
+		m.Settings.Public = *update.Public
+	}
+	if update.Passcode != nil {
+		// An empty passcode makes the room public again
+		m.PasscodeHash = ""
+		if *update.Passcode != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(*update.Passcode), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			m.PasscodeHash = string(hash)
+		}
+	}
+	return nil
+}
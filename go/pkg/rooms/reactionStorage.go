@@ -0,0 +1,35 @@
+package rooms
+
+import (
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"gorm.io/gorm/clause"
+)
+
+type ReactionStore interface {
+	SaveReaction(reaction *MessageReaction) error
+	DeleteReaction(messageID, userID uint, emoji string) (bool, error)
+	GetReactionsByMessageID(messageID uint) ([]MessageReaction, error)
+}
+
+type ReactionStorage struct {
+	db *db.Database
+}
+
+// SaveReaction adds a reaction, doing nothing if the user already reacted to the message with that emoji
+func (s *ReactionStorage) SaveReaction(reaction *MessageReaction) error {
+	result := s.db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(reaction)
+	return result.Error
+}
+
+// DeleteReaction removes a reaction, reporting whether there was one
+func (s *ReactionStorage) DeleteReaction(messageID, userID uint, emoji string) (bool, error) {
+	// Conditions from a struct skip zero values, so an empty emoji would delete every reaction the user made
+	result := s.db.DB.Where("chat_room_log_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).Delete(&MessageReaction{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *ReactionStorage) GetReactionsByMessageID(messageID uint) ([]MessageReaction, error) {
+	reactions := []MessageReaction{}
+	result := s.db.DB.Where(MessageReaction{ChatRoomLogID: messageID}).Order("id").Find(&reactions)
+	return reactions, result.Error
+}
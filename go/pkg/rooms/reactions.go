@@ -0,0 +1,104 @@
+package rooms
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+var (
+	ErrInvalidEmoji = errors.New("a reaction must be a single emoji of at most 32 bytes")
+	ErrNoReaction   = errors.New("you have not reacted to this message with that emoji")
+)
+
+const maxEmojiLength = 32
+
+// MessageReaction is one user's reaction to a message. A user can react to a message with several emoji, but each only once.
+type MessageReaction struct {
+	ID            uint   `gorm:"primaryKey"`
+	ChatRoomLogID uint   `gorm:"uniqueIndex:idx_reaction_message_user,priority:1"`
+	UserID        uint   `gorm:"uniqueIndex:idx_reaction_message_user,priority:2"`
+	Emoji         string `gorm:"uniqueIndex:idx_reaction_message_user,priority:3"`
+	CreatedAt     time.Time
+}
+
+// reactionData counts a message's reactions by emoji, in the order each emoji was first used
+func reactionData(reactions []MessageReaction) []types.ReactionData {
+	data := []types.ReactionData{}
+	index := map[string]int{}
+	for _, reaction := range reactions {
+		i, ok := index[reaction.Emoji]
+		if !ok {
+			i = len(data)
+			index[reaction.Emoji] = i
+			data = append(data, types.ReactionData{Emoji: reaction.Emoji, UserIDs: []uint{}})
+		}
+		data[i].Count++
+		data[i].UserIDs = append(data[i].UserIDs, reaction.UserID)
+	}
+	return data
+}
+
+// validateEmoji checks a reaction looks like an emoji: no letters or spaces, and at least one pictograph.
+// Keycaps like 1️⃣ are a digit followed by an enclosing mark, so those count as pictographs too.
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return ErrInvalidEmoji
+	}
+	if strings.IndexFunc(emoji, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsLetter(r) || unicode.IsControl(r) }) >= 0 {
+		return ErrInvalidEmoji
+	}
+	if strings.IndexFunc(emoji, func(r rune) bool { return unicode.In(r, unicode.So, unicode.Me) }) < 0 {
+		return ErrInvalidEmoji
+	}
+	return nil
+}
+
+// AddReaction reacts to a message the visitor can see. Reacting again with the same emoji changes nothing.
+func (s *ChatRoomsService) AddReaction(visitor *Visitor, messageID uint, emoji string) (types.UserMessageData, error) {
+	if err := validateEmoji(emoji); err != nil {
+		return types.UserMessageData{}, err
+	}
+	chatLog, err := s.visibleChatLog(visitor, messageID)
+	if err != nil {
+		return types.UserMessageData{}, err
+	}
+	if err := s.ReactionStorage.SaveReaction(&MessageReaction{ChatRoomLogID: chatLog.ID, UserID: visitor.User.ID, Emoji: emoji}); err != nil {
+		return types.UserMessageData{}, err
+	}
+	return s.reactionsChanged(visitor.Room, chatLog)
+}
+
+// RemoveReaction takes back one of the visitor's reactions
+func (s *ChatRoomsService) RemoveReaction(visitor *Visitor, messageID uint, emoji string) (types.UserMessageData, error) {
+	if err := validateEmoji(emoji); err != nil {
+		return types.UserMessageData{}, err
+	}
+	chatLog, err := s.visibleChatLog(visitor, messageID)
+	if err != nil {
+		return types.UserMessageData{}, err
+	}
+	found, err := s.ReactionStorage.DeleteReaction(chatLog.ID, visitor.User.ID, emoji)
+	if err != nil {
+		return types.UserMessageData{}, err
+	}
+	if !found {
+		return types.UserMessageData{}, ErrNoReaction
+	}
+	return s.reactionsChanged(visitor.Room, chatLog)
+}
+
+// reactionsChanged reloads a message's reactions into the room's chat log cache
+func (s *ChatRoomsService) reactionsChanged(room *ChatRoom, chatLog *ChatRoomLog) (types.UserMessageData, error) {
+	reactions, err := s.ReactionStorage.GetReactionsByMessageID(chatLog.ID)
+	if err != nil {
+		return types.UserMessageData{}, err
+	}
+	chatLog.Reactions = reactions
+	room.replaceChatLog(*chatLog)
+	return chatLog.Data(), nil
+}
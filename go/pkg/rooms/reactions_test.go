@@ -0,0 +1,48 @@
+package rooms
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateEmoji(t *testing.T) {
+	for _, emoji := range []string{"👍", "❤️", "🇳🇿", "1️⃣", "👩‍👩‍👧", "👋🏽"} {
+		if err := validateEmoji(emoji); err != nil {
+			t.Errorf("%q was refused: %v", emoji, err)
+		}
+	}
+	for _, emoji := range []string{"", "lol", "1", ":)", "é", "👍 lol", "👍\n", "👍👍👍👍👍👍👍👍👍"} {
+		if err := validateEmoji(emoji); !errors.Is(err, ErrInvalidEmoji) {
+			t.Errorf("%q was accepted", emoji)
+		}
+	}
+}
+
+// TestRemoveReaction only takes back the one reaction asked for
+func TestRemoveReaction(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	visitor := s.joinChat(t, room)
+	message := s.say(t, visitor, "hello", 0)
+
+	for _, emoji := range []string{"👍", "🎉"} {
+		if _, err := s.AddReaction(visitor, message.ID, emoji); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.RemoveReaction(visitor, message.ID, ""); !errors.Is(err, ErrInvalidEmoji) {
+		t.Errorf("removing an empty emoji: %v", err)
+	}
+	if _, err := s.RemoveReaction(visitor, message.ID, "😀"); !errors.Is(err, ErrNoReaction) {
+		t.Errorf("removing a reaction that was never made: %v", err)
+	}
+
+	updated, err := s.RemoveReaction(visitor, message.ID, "👍")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Reactions) != 1 || updated.Reactions[0].Emoji != "🎉" {
+		t.Errorf("reactions left are %+v, want just 🎉", updated.Reactions)
+	}
+}
@@ -0,0 +1,30 @@
+package rooms
+
+import (
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"gorm.io/gorm/clause"
+)
+
+type RoleStore interface {
+	SaveRole(roomRole *RoomRole) error
+	GetRolesByRoomID(roomID uint) ([]RoomRole, error)
+}
+
+type RoleStorage struct {
+	db *db.Database
+}
+
+// SaveRole gives a user a role in a room, replacing any role they had there
+func (s *RoleStorage) SaveRole(roomRole *RoomRole) error {
+	result := s.db.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "room_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role"}),
+	}).Create(roomRole)
+	return result.Error
+}
+
+func (s *RoleStorage) GetRolesByRoomID(roomID uint) ([]RoomRole, error) {
+	roles := []RoomRole{}
+	result := s.db.DB.Where(RoomRole{RoomID: roomID}).Find(&roles)
+	return roles, result.Error
+}
@@ -0,0 +1,166 @@
+package rooms
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+type Role string
+
+const (
+	RoleOwner     Role = "owner"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	RoleGuest     Role = "guest"
+)
+
+// ErrOwnerRole is returned when someone tries to hand out the owner role. A room has one owner, who keeps it.
+var ErrOwnerRole = errors.New("the owner role can not be given to anyone else")
+
+// Permission names something only some roles may do in a room
+type Permission string
+
+const (
+	PermEditRoom     Permission = "edit_room"
+	PermChangeMode   Permission = "change_mode"
+	PermApproveHands Permission = "approve_hands"
+	PermModerate     Permission = "moderate"
+	PermManageMedia  Permission = "manage_media"
+	PermPresent      Permission = "present"
+	PermSetRoles     Permission = "set_roles"
+	PermAdmit        Permission = "admit"
+	PermInvite       Permission = "invite"
+	PermListRoom     Permission = "list_room"
+	PermBreakouts    Permission = "breakouts"
+	PermAttendance   Permission = "view_attendance"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleOwner: {
+		PermEditRoom, PermChangeMode, PermApproveHands, PermModerate, PermManageMedia, PermPresent, PermSetRoles, PermAdmit, PermInvite, PermListRoom, PermBreakouts, PermAttendance,
+	},
+	RoleModerator: {
+		PermEditRoom, PermChangeMode, PermApproveHands, PermModerate, PermManageMedia, PermPresent, PermAdmit, PermInvite, PermBreakouts, PermAttendance,
+	},
+	RoleMember: {},
+	RoleGuest:  {},
+}
+
+// roleRanks orders roles so that an invite never lowers someone's role
+var roleRanks = map[Role]int{
+	RoleGuest:     0,
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleOwner:     3,
+}
+
+// RoomRole is a role given to a user in one room
+type RoomRole struct {
+	ID     uint `gorm:"primaryKey"`
+	RoomID uint `gorm:"uniqueIndex:idx_room_user"`
+	UserID uint `gorm:"uniqueIndex:idx_room_user"`
+	Role   Role
+}
+
+// ParseRole checks that a role sent by a client exists
+func ParseRole(role string) (Role, error) {
+	if _, ok := rolePermissions[Role(role)]; !ok {
+		return "", fmt.Errorf("role must be %s, %s, %s or %s", RoleOwner, RoleModerator, RoleMember, RoleGuest)
+	}
+	return Role(role), nil
+}
+
+// roleOf works out a user's role in the room. The room's owner is always an owner,
+// otherwise an assigned role wins, and anyone else is a member once they have set a password.
+// It must run on the room's goroutine.
+func (r *ChatRoom) roleOf(user *users.User) Role {
+	if user == nil {
+		return RoleGuest
+	}
+	if r.OwnerID != 0 && user.ID == r.OwnerID {
+		return RoleOwner
+	}
+	if role, ok := r.roles[user.ID]; ok {
+		return role
+	}
+	if user.Password != "" {
+		return RoleMember
+	}
+	return RoleGuest
+}
+
+// can is the single authorization check for privileged work orders.
+// It must run on the room's goroutine.
+func (r *ChatRoom) can(user *users.User, permission Permission) bool {
+	if user != nil && user.Admin != 0 {
+		return true
+	}
+	for _, p := range rolePermissions[r.roleOf(user)] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether a user's role in the room grants permission, for users who have not joined it
+func (r *ChatRoom) Allows(user *users.User, permission Permission) bool {
+	allowed := false
+	r.do(func() {
+		allowed = r.can(user, permission)
+	})
+	return allowed
+}
+
+// Role returns a visitor's role in their room
+func (v *Visitor) Role() Role {
+	var role Role
+	v.Room.WithVisitor(v, func(v *Visitor) {
+		role = v.Room.roleOf(v.User)
+	})
+	return role
+}
+
+// Can reports whether a visitor's role in their room grants permission
+func (v *Visitor) Can(permission Permission) bool {
+	allowed := false
+	v.Room.WithVisitor(v, func(v *Visitor) {
+		allowed = v.Room.can(v.User, permission)
+	})
+	return allowed
+}
+
+// setRole records a user's role in the room once it has been persisted
+func (r *ChatRoom) setRole(userID uint, role Role) {
+	r.do(func() {
+		r.roles[userID] = role
+	})
+}
+
+// Roles lists the role of everyone who has been given one, and the owner
+func (r *ChatRoom) Roles() []types.RoleData {
+	var roles []types.RoleData
+	r.do(func() {
+		roles = r.roleData()
+	})
+	return roles
+}
+
+func (r *ChatRoom) roleData() []types.RoleData {
+	roles := []types.RoleData{}
+	if r.OwnerID != 0 {
+		roles = append(roles, types.RoleData{UserID: r.OwnerID, Role: string(RoleOwner)})
+	}
+	for userID, role := range r.roles {
+		if userID == r.OwnerID {
+			continue
+		}
+		roles = append(roles, types.RoleData{UserID: userID, Role: string(role)})
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].UserID < roles[j].UserID })
+	return roles
+}
@@ -0,0 +1,27 @@
+package rooms
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOwnerRoleCanNotBeGiven(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	user := s.createUser(t)
+
+	if err := s.SetRole(room, user.ID, RoleOwner); !errors.Is(err, ErrOwnerRole) {
+		t.Errorf("owner role was given out: %v", err)
+	}
+	if _, _, err := s.CreateInvite(room, user.ID, RoleOwner, time.Hour, 1); !errors.Is(err, ErrOwnerRole) {
+		t.Errorf("invite carries the owner role: %v", err)
+	}
+	if err := s.SetRole(room, user.ID, RoleModerator); err != nil {
+		t.Error(err)
+	}
+	if room.Allows(user, PermSetRoles) {
+		t.Error("moderator can hand out roles")
+	}
+}
@@ -2,10 +2,13 @@ package rooms
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Embiggenerd/spiritio/pkg/config"
 	"github.com/Embiggenerd/spiritio/pkg/sfu"
+	"github.com/Embiggenerd/spiritio/pkg/users"
 	"github.com/Embiggenerd/spiritio/pkg/utils"
 	"github.com/Embiggenerd/spiritio/pkg/websocketClient"
 	"github.com/Embiggenerd/spiritio/types"
@@ -17,56 +20,401 @@ type Room interface {
 	Build(ctx context.Context, cfg *config.Config)
 	AddPeerConnection(pc *webrtc.PeerConnection, w *websocketClient.ThreadSafeWriter)
 	BroadcastEvent(event *types.Event)
-	AddVisitor(visitor *Visitor)
+	AddVisitor(visitor *Visitor, user *users.User) error
 }
 
+const (
+	RoomModeMeeting = "meeting"
+	RoomModeWebinar = "webinar"
+)
+
 type ChatRoom struct {
-	Service  *ChatRoomsService `gorm:"-:all"`
-	ID       uint              `gorm:"primaryKey"`
-	SFU      sfu.SFU           `gorm:"-:all"`
-	ChatLog  []ChatRoomLog     `gorm:"-:all"`
-	Visitors []*Visitor        `gorm:"-:all"`
+	Service      *ChatRoomsService `gorm:"-:all"`
+	ID           uint              `gorm:"primaryKey"`
+	Mode         string            `gorm:"default:meeting"`
+	LastActiveAt time.Time
+	RoomMetadata `gorm:"embedded"`
+	SFU          sfu.SFU `gorm:"-:all"`
+	chatLog      []ChatRoomLog
+	// chatHasMore is set once older messages exist than the window kept in chatLog
+	chatHasMore bool
+	// lastSeq is the sequence number of the room's latest message
+	lastSeq  uint64
+	visitors []*Visitor
+	lobby    []*Visitor
+	roles    map[uint]Role
+	// occurrenceStart and occurrenceEnd bound the scheduled meeting under way, warnedFor is the start of the last one hosts were warned about
+	occurrenceStart time.Time
+	occurrenceEnd   time.Time
+	warnedFor       time.Time
+	// breakouts holds the ids of the room's open breakouts, which are recalled at breakoutsEnd if it is set.
+	// creatingBreakouts is set while they are being made, so that nobody else makes another set.
+	breakouts         []uint
+	breakoutsEnd      time.Time
+	breakoutTimer     *time.Timer
+	creatingBreakouts bool
+	commands          chan func()
+	done              chan struct{}
+	closed            bool
+	closeOnce         sync.Once
 }
 
 func (r *ChatRoom) AddPeerConnection(pc *webrtc.PeerConnection, w *websocketClient.ThreadSafeWriter) {
 	r.SFU.AddPeerConnection(pc, w)
 }
 
-func (r *ChatRoom) Build(ctx context.Context, service *ChatRoomsService) {
-	if r.ChatLog == nil {
-		r.ChatLog = []ChatRoomLog{}
+// Build starts a room, and fails if the room's codec policy can't be negotiated
+func (r *ChatRoom) Build(ctx context.Context, service *ChatRoomsService) error {
+	unit, err := sfu.NewSelectiveForwardingUnit(service.cfg.CodecPolicy(r.Slug))
+	if err != nil {
+		return fmt.Errorf("room %s: %w", r.Slug, err)
+	}
+	r.SFU = unit
+
+	if r.chatLog == nil {
+		r.chatLog = []ChatRoomLog{}
+	}
+	if r.roles == nil {
+		r.roles = map[uint]Role{}
 	}
 
 	r.Service = service
+	r.commands = make(chan func())
+	r.done = make(chan struct{})
+	r.LastActiveAt = time.Now()
+	go r.run()
+
+	go r.every(time.Second*3, r.SFU.DispatchKeyFrame)
 
-	r.SFU = sfu.NewSelectiveForwardingUnit()
-	go func() {
-		for range time.NewTicker(time.Second * 3).C {
-			r.SFU.DispatchKeyFrame()
+	interval := time.Duration(service.cfg.QualityReportInterval) * time.Second
+	go r.every(interval, r.ReportConnectionQuality)
+	go r.every(scheduleCheckInterval, func() { service.checkSchedule(r) })
+	return nil
+}
+
+// ConnectionQuality pairs the SFU's stats for each PeerConnection with the visitor that owns it
+func (r *ChatRoom) ConnectionQuality() []types.ConnectionQualityData {
+	data := []types.ConnectionQualityData{}
+	qualities := r.SFU.ConnectionQuality()
+	r.do(func() {
+		for _, q := range qualities {
+			for _, v := range r.visitors {
+				if v.PeerConnection != q.PeerConnection {
+					continue
+				}
+				d := types.ConnectionQualityData{
+					StreamID: v.StreamID,
+					Quality:  q.Stats.Quality,
+					Stats:    q.Stats,
+				}
+				if v.User != nil {
+					d.UserID = v.User.ID
+					d.Name = v.User.Name
+				}
+				data = append(data, d)
+				break
+			}
 		}
-	}()
+	})
+	return data
+}
+
+// ReportConnectionQuality broadcasts a connection_quality event for each participant
+func (r *ChatRoom) ReportConnectionQuality() {
+	for _, d := range r.ConnectionQuality() {
+		r.BroadcastEvent(&types.Event{Event: "connection_quality", Data: d})
+	}
 }
 
 func (r *ChatRoom) BroadcastEvent(event *types.Event) {
-	for _, v := range r.Visitors {
-		v.Client.Writer.WriteJSON(event)
+	r.do(func() {
+		r.broadcastEvent(event)
+	})
+}
+
+// broadcastEvent sends an event to every signed in visitor. Visitors who have not signed in yet
+// might be banned, so they see nothing of the room until they do. Writes are queued, so a slow
+// client never holds up the room.
+func (r *ChatRoom) broadcastEvent(event *types.Event) {
+	for _, v := range r.visitors {
+		if v.User != nil {
+			v.Client.Writer.WriteJSON(event)
+		}
+	}
+}
+
+// NotifyPermitted sends an event to every visitor whose role grants permission
+func (r *ChatRoom) NotifyPermitted(permission Permission, event *types.Event) {
+	r.do(func() {
+		for _, v := range r.visitors {
+			if v.User != nil && r.can(v.User, permission) {
+				v.Notify(event)
+			}
+		}
+	})
+}
+
+// NotifyUser sends an event to every connection a user has open in the room, reporting whether they are present
+func (r *ChatRoom) NotifyUser(userID uint, event *types.Event) bool {
+	present := false
+	r.do(func() {
+		for _, v := range r.visitors {
+			if v.User != nil && v.User.ID == userID {
+				present = true
+				v.Notify(event)
+			}
+		}
+	})
+	return present
+}
+
+// CanPublish reports whether a user may send media into the room from outside it, as WHIP encoders do.
+// In webinar mode only presenters, moderators and owners can.
+func (r *ChatRoom) CanPublish(user *users.User) bool {
+	canPublish := false
+	r.do(func() {
+		canPublish = r.canPublish(user)
+		for _, v := range r.visitors {
+			if v.Presenter && v.User != nil && v.User.ID == user.ID {
+				canPublish = true
+			}
+		}
+	})
+	return canPublish
+}
+
+func (r *ChatRoom) canPublish(user *users.User) bool {
+	return r.Mode != RoomModeWebinar || r.can(user, PermPresent)
+}
+
+// Presenters lists the visitors who may publish while the room is in webinar mode
+func (r *ChatRoom) Presenters() []types.Visitor {
+	var presenters []types.Visitor
+	r.do(func() {
+		presenters = r.presenters()
+	})
+	return presenters
+}
+
+func (r *ChatRoom) presenters() []types.Visitor {
+	presenters := []types.Visitor{}
+	for _, v := range r.visitors {
+		if v.User != nil && (v.Presenter || r.can(v.User, PermPresent)) {
+			presenters = append(presenters, types.Visitor{ID: v.User.ID, Name: v.User.Name})
+		}
+	}
+	return presenters
+}
+
+// Guests lists the logged in visitors, once per user
+func (r *ChatRoom) Guests() types.CurrentGuestsData {
+	guests := types.CurrentGuestsData{}
+	r.do(func() {
+		for _, v := range r.visitors {
+			if v.User != nil {
+				guests = append(guests, types.CurrentGuest{Name: v.User.Name, ID: v.User.ID})
+			}
+		}
+	})
+	return utils.RemoveDuplicate(guests)
+}
+
+// StreamOwnerName returns the name of the visitor publishing a stream
+func (r *ChatRoom) StreamOwnerName(streamID string) (string, bool) {
+	name, found := "", false
+	r.do(func() {
+		for _, v := range r.visitors {
+			if v.StreamID == streamID && v.User != nil {
+				name, found = v.User.Name, true
+				return
+			}
+		}
+	})
+	return name, found
+}
+
+// JoinedRoomData describes the room to a user who just joined it
+func (r *ChatRoom) JoinedRoomData(user *users.User) types.JoinedRoomData {
+	var data types.JoinedRoomData
+	r.do(func() {
+		data = r.joinedRoomData(user)
+	})
+	return data
+}
+
+func (r *ChatRoom) joinedRoomData(user *users.User) types.JoinedRoomData {
+	// create chat events from room's chatlog cache, leaving out other people's direct messages
+	var userID uint
+	if user != nil {
+		userID = user.ID
+	}
+	var chats []types.UserMessageData
+	for _, chat := range r.chatLog {
+		if chat.visibleTo(userID) {
+			chats = append(chats, chat.Data())
+		}
 	}
+	// The cursor stays at the start of the whole window, so paging back skips nothing
+	var chatCursor uint
+	if len(r.chatLog) > 0 {
+		chatCursor = r.chatLog[0].ID
+	}
+
+	visitors := []types.Visitor{}
+	for _, v := range r.visitors {
+		if v.User != nil {
+			visitors = append(visitors, types.Visitor{ID: v.User.ID, Name: v.User.Name})
+		}
+	}
+
+	return types.JoinedRoomData{
+		RoomID:      r.ID,
+		ChatLog:     chats,
+		ChatCursor:  chatCursor,
+		HasMoreChat: r.chatHasMore,
+		Visitors:    visitors,
+		Mode:        r.Mode,
+		Presenters:  r.presenters(),
+		Room:        r.roomData(),
+		Roles:       r.roleData(),
+	}
+}
+
+// AppendChatLog adds a saved message to the room's chat log cache, dropping the oldest once it is full
+func (r *ChatRoom) AppendChatLog(chatRoomLog ChatRoomLog) {
+	r.do(func() {
+		r.chatLog = append(r.chatLog, chatRoomLog)
+		if window := r.Service.cfg.ChatWindowSize; len(r.chatLog) > window {
+			r.chatLog = append([]ChatRoomLog{}, r.chatLog[len(r.chatLog)-window:]...)
+			r.chatHasMore = true
+		}
+	})
+}
+
+// SetMode switches the room's mode once it has been persisted. It returns the connections of
+// visitors who were publishing but may no longer, so their media can be stopped.
+func (r *ChatRoom) SetMode(mode string) (silenced []*webrtc.PeerConnection) {
+	r.do(func() {
+		r.Mode = mode
+		if mode != RoomModeWebinar {
+			return
+		}
+		for _, v := range r.visitors {
+			if v.PeerConnection != nil && !v.Presenter && !r.can(v.User, PermPresent) {
+				silenced = append(silenced, v.PeerConnection)
+			}
+		}
+	})
+	return silenced
 }
 
-func (r *ChatRoom) AddVisitor(visitor *Visitor) {
-	visitor.SocketID = r.untilUnique(uuid.NewString())
-	r.Visitors = append(r.Visitors, visitor)
+// WithVisitor reads or changes a visitor's state on the room's goroutine, so other visitors never see it half written
+func (r *ChatRoom) WithVisitor(visitor *Visitor, f func(v *Visitor)) {
+	r.do(func() {
+		f(visitor)
+	})
+}
+
+// PromoteRaisedHand makes every connection of a user with their hand raised a presenter and tells them so.
+// It returns the promoted connections' PeerConnections, which need receivers to start publishing.
+func (r *ChatRoom) PromoteRaisedHand(userID uint) (promoted bool, pcs []*webrtc.PeerConnection) {
+	r.do(func() {
+		for _, v := range r.visitors {
+			if v.User == nil || v.User.ID != userID || !v.HandRaised {
+				continue
+			}
+			v.HandRaised = false
+			v.Presenter = true
+			promoted = true
+
+			v.Notify(&types.Event{Event: "promoted_to_presenter", Data: r.ID})
+			if v.PeerConnection != nil {
+				pcs = append(pcs, v.PeerConnection)
+			}
+		}
+	})
+	return promoted, pcs
+}
+
+// AddVisitor lets a visitor into the room, or its lobby. user is who the visitor authenticated as on
+// the way in, if anyone. Those who can edit the room get in even when it is locked or full.
+func (r *ChatRoom) AddVisitor(visitor *Visitor, user *users.User) error {
+	var err error
+	waiting := false
+	ran := r.do(func() {
+		exempt := user != nil && r.can(user, PermEditRoom)
+		if r.Settings.Locked && !exempt {
+			err = ErrRoomLocked
+			return
+		}
+		if r.Settings.MaxSize > 0 && len(r.visitors) >= r.Settings.MaxSize && !exempt {
+			err = ErrRoomFull
+			return
+		}
+		visitor.SocketID = r.untilUnique(uuid.NewString())
+		r.LastActiveAt = time.Now()
+		if r.holding() {
+			visitor.Waiting = true
+			waiting = true
+			r.lobby = append(r.lobby, visitor)
+			return
+		}
+		r.visitors = append(r.visitors, visitor)
+	})
+	if !ran {
+		return ErrRoomClosed
+	}
+	if err == nil && !waiting {
+		if r.Service != nil {
+			r.Service.startAttendance(r, visitor)
+		}
+		r.OccupancyChanged()
+	}
+	return err
+}
+
+// RemoveVisitor takes a visitor out of the room, reporting whether they were in it.
+// Visitors still waiting in the lobby are dropped from it, but were never in the room.
+func (r *ChatRoom) RemoveVisitor(visitor *Visitor) bool {
+	removed := false
+	r.do(func() {
+		r.LastActiveAt = time.Now()
+		for i, v := range r.lobby {
+			if visitor.SocketID == v.SocketID {
+				r.lobby = append(r.lobby[:i], r.lobby[i+1:]...)
+				return
+			}
+		}
+		for i, v := range r.visitors {
+			if visitor.SocketID == v.SocketID {
+				r.visitors = append(r.visitors[:i], r.visitors[i+1:]...)
+				removed = true
+				return
+			}
+		}
+	})
+	if removed {
+		if r.Service != nil {
+			r.Service.endAttendance(r, visitor)
+		}
+		r.OccupancyChanged()
+	}
+	return removed
 }
 
 func (r *ChatRoom) CreateUniqueDisplayName() string {
-	return r.untilUnique(utils.RandName())
+	var name string
+	r.do(func() {
+		name = r.untilUnique(utils.RandName())
+	})
+	return name
 }
 
 func (r *ChatRoom) untilUnique(id string) string {
 	unique := true
-	if r.Visitors != nil {
+	if r.visitors != nil {
 
-		for _, v := range r.Visitors {
+		for _, v := range r.visitors {
 			if v.User != nil {
 				if id == v.SocketID {
 					unique = false
@@ -2,13 +2,22 @@ package rooms
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/Embiggenerd/spiritio/pkg/db"
 )
 
 type RoomStore interface {
-	CreateRoom(ctx context.Context) (*ChatRoom, error)
+	CreateRoom(ctx context.Context, slug string, createdByID uint) (*ChatRoom, error)
 	FindRoomByID(roomID uint) (*ChatRoom, error)
+	FindRoomBySlug(slug string) (*ChatRoom, error)
+	FindRoomsWithoutSlugs() ([]ChatRoom, error)
+	FindPublicRooms(query string) ([]ChatRoom, error)
+	FindBreakouts(parentID uint) ([]ChatRoom, error)
+	UpdateRoomMode(roomID uint, mode string) error
+	UpdateRoomActivity(roomID uint, lastActiveAt time.Time) error
+	UpdateRoomMetadata(roomID uint, metadata RoomMetadata) error
 }
 
 type RoomStorage struct {
@@ -16,8 +25,12 @@ type RoomStorage struct {
 }
 
 // CreateRoom creates a new room
-func (r *RoomStorage) CreateRoom(ctx context.Context) (*ChatRoom, error) {
-	newRoom := &ChatRoom{}
+func (r *RoomStorage) CreateRoom(ctx context.Context, slug string, createdByID uint) (*ChatRoom, error) {
+	newRoom := &ChatRoom{RoomMetadata: RoomMetadata{
+		Slug:        slug,
+		CreatedByID: createdByID,
+		Settings:    RoomSettings{ChatEnabled: true, VideoEnabled: true},
+	}}
 	roomResult := r.db.DB.Create(newRoom)
 	return newRoom, roomResult.Error
 }
@@ -27,3 +40,57 @@ func (r *RoomStorage) FindRoomByID(roomID uint) (*ChatRoom, error) {
 	roomResult := r.db.DB.Where(ChatRoom{ID: roomID}).First(foundRoom)
 	return foundRoom, roomResult.Error
 }
+
+func (r *RoomStorage) FindRoomBySlug(slug string) (*ChatRoom, error) {
+	foundRoom := &ChatRoom{}
+	roomResult := r.db.DB.Where("slug = ?", slug).First(foundRoom)
+	return foundRoom, roomResult.Error
+}
+
+// FindRoomsWithoutSlugs finds rooms created before rooms had slugs
+func (r *RoomStorage) FindRoomsWithoutSlugs() ([]ChatRoom, error) {
+	rooms := []ChatRoom{}
+	result := r.db.DB.Where("slug IS NULL OR slug = ''").Find(&rooms)
+	return rooms, result.Error
+}
+
+// FindPublicRooms finds up to 50 public rooms whose slug, name or topic contains query, most recently active first
+func (r *RoomStorage) FindPublicRooms(query string) ([]ChatRoom, error) {
+	rooms := []ChatRoom{}
+	tx := r.db.DB.Where("public = ?", true)
+	if query != "" {
+		like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+		tx = tx.Where(`slug LIKE ? ESCAPE '\' OR name LIKE ? ESCAPE '\' OR topic LIKE ? ESCAPE '\'`, like, like, like)
+	}
+	result := tx.Order("last_active_at DESC").Limit(50).Find(&rooms)
+	return rooms, result.Error
+}
+
+// FindBreakouts finds a room's breakouts that have not ended
+func (r *RoomStorage) FindBreakouts(parentID uint) ([]ChatRoom, error) {
+	rooms := []ChatRoom{}
+	result := r.db.DB.Where("parent_id = ? AND locked = ?", parentID, false).Order("id").Find(&rooms)
+	return rooms, result.Error
+}
+
+func (r *RoomStorage) UpdateRoomMode(roomID uint, mode string) error {
+	result := r.db.DB.Model(&ChatRoom{ID: roomID}).Update("mode", mode)
+	return result.Error
+}
+
+func (r *RoomStorage) UpdateRoomActivity(roomID uint, lastActiveAt time.Time) error {
+	result := r.db.DB.Model(&ChatRoom{ID: roomID}).Update("last_active_at", lastActiveAt)
+	return result.Error
+}
+
+func (r *RoomStorage) UpdateRoomMetadata(roomID uint, metadata RoomMetadata) error {
+	// Select every column so that false and empty values are written too
+	result := r.db.DB.Model(&ChatRoom{ID: roomID}).
+		Select(
+			"slug", "name", "topic", "owner_id", "created_by_id", "passcode_hash",
+			"chat_enabled", "video_enabled", "max_size", "locked", "lobby_enabled", "invite_only", "public",
+			"schedule_starts_at", "schedule_ends_at", "schedule_recurrence", "parent_id",
+		).
+		Updates(&ChatRoom{RoomMetadata: metadata})
+	return result.Error
+}
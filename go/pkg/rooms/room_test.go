@@ -0,0 +1,356 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/config"
+	"github.com/Embiggenerd/spiritio/pkg/websocketClient"
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+// TestRoomConcurrentVisitors joins, chats in and leaves a room from many goroutines while it closes under them.
+// Run it with -race.
+func TestRoomConcurrentVisitors(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+
+	const visitors = 20
+	const messages = 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, visitors*(messages+2))
+	for i := 0; i < visitors; i++ {
+		user := s.createUser(t)
+		client := newTestClient(t)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			visitor := NewVisitor(client, nil, room)
+			if err := room.AddVisitor(visitor, nil); err != nil {
+				errs <- err
+				return
+			}
+			if err := visitor.AddUser(user); err != nil {
+				errs <- err
+			}
+			for j := 0; j < messages; j++ {
+				_, _, err := s.SaveChatLog(types.UserMessageData{
+					Text:         fmt.Sprintf("message %d from %d", j, i),
+					FromUserID:   user.ID,
+					FromUserName: user.Name,
+				}, visitor)
+				if err != nil {
+					errs <- err
+				}
+				room.BroadcastEvent(&types.Event{Event: "user_message"})
+			}
+			room.JoinedRoomData(nil)
+			room.Guests()
+			room.RemoveVisitor(visitor)
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.CloseRoom(room, "test over")
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if !errors.Is(err, ErrRoomClosed) {
+			t.Error(err)
+		}
+	}
+	if ran := room.do(func() {}); ran {
+		t.Error("room still runs commands after it closed")
+	}
+}
+
+// TestRoomConcurrentChat keeps sequence numbers unique when many visitors chat at once
+func TestRoomConcurrentChat(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+
+	const visitors = 10
+	const messages = 10
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seqs := map[uint64]bool{}
+	for i := 0; i < visitors; i++ {
+		user := s.createUser(t)
+		visitor := NewVisitor(newTestClient(t), nil, room)
+		if err := room.AddVisitor(visitor, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := visitor.AddUser(user); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer room.RemoveVisitor(visitor)
+			for j := 0; j < messages; j++ {
+				saved, _, err := s.SaveChatLog(types.UserMessageData{Text: "hi", FromUserID: user.ID, FromUserName: user.Name}, visitor)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seqs[saved.Seq] {
+					t.Errorf("sequence number %d given out twice", saved.Seq)
+				}
+				seqs[saved.Seq] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seqs) != visitors*messages {
+		t.Errorf("saved %d messages, want %d", len(seqs), visitors*messages)
+	}
+	if window := len(room.JoinedRoomData(nil).ChatLog); window != s.cfg.ChatWindowSize {
+		t.Errorf("chat window holds %d messages, want %d", window, s.cfg.ChatWindowSize)
+	}
+	s.CloseRoom(room, "test over")
+}
+
+func TestAddVisitorLockedRoom(t *testing.T) {
+	s := newTestService(t)
+	owner := s.createUser(t)
+	room, err := s.CreateRoom(s.ctx, owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseRoom(room, "test over")
+	if !room.claim(owner.ID) {
+		t.Fatal("the room's creator could not claim it")
+	}
+
+	metadata := room.Metadata()
+	metadata.Settings.Locked = true
+	room.SetMetadata(metadata)
+
+	if err := room.AddVisitor(NewVisitor(newTestClient(t), nil, room), nil); !errors.Is(err, ErrRoomLocked) {
+		t.Errorf("anonymous visitor joined a locked room: %v", err)
+	}
+	if err := room.AddVisitor(NewVisitor(newTestClient(t), nil, room), s.createUser(t)); !errors.Is(err, ErrRoomLocked) {
+		t.Errorf("guest joined a locked room: %v", err)
+	}
+	if err := room.AddVisitor(NewVisitor(newTestClient(t), nil, room), owner); err != nil {
+		t.Errorf("owner was kept out of their locked room: %v", err)
+	}
+
+	metadata.Settings.Locked = false
+	metadata.Settings.MaxSize = 1
+	room.SetMetadata(metadata)
+	if err := room.AddVisitor(NewVisitor(newTestClient(t), nil, room), nil); !errors.Is(err, ErrRoomFull) {
+		t.Errorf("visitor joined a full room: %v", err)
+	}
+	if err := room.AddVisitor(NewVisitor(newTestClient(t), nil, room), owner); err != nil {
+		t.Errorf("owner was kept out of their full room: %v", err)
+	}
+}
+
+func TestClaimRoom(t *testing.T) {
+	s := newTestService(t)
+	creator := s.createUser(t)
+	room, err := s.CreateRoom(s.ctx, creator.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseRoom(room, "test over")
+
+	if room.claim(s.createUser(t).ID) {
+		t.Error("a visitor who did not create the room claimed it")
+	}
+	if !room.claim(creator.ID) {
+		t.Error("the room's creator could not claim it")
+	}
+	if room.claim(creator.ID) {
+		t.Error("a claimed room was claimed again")
+	}
+
+	unclaimed := s.createRoom(t)
+	defer s.CloseRoom(unclaimed, "test over")
+	if unclaimed.claim(creator.ID) {
+		t.Error("a room without a creator was claimed")
+	}
+}
+
+// TestCanPublishWebinar only lets presenters publish from outside a webinar, as WHIP encoders do
+func TestCanPublishWebinar(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	audience, moderator := s.createUser(t), s.createUser(t)
+	if err := s.SetRole(room, moderator.ID, RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+
+	if !room.CanPublish(audience) {
+		t.Error("a guest can not publish into a meeting")
+	}
+	if err := s.SetRoomMode(room, RoomModeWebinar); err != nil {
+		t.Fatal(err)
+	}
+	if room.CanPublish(audience) {
+		t.Error("the audience can publish into a webinar")
+	}
+	if !room.CanPublish(moderator) {
+		t.Error("a moderator can not publish into a webinar")
+	}
+
+	visitor := NewVisitor(newTestClient(t), nil, room)
+	if err := room.AddVisitor(visitor, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := visitor.AddUser(audience); err != nil {
+		t.Fatal(err)
+	}
+	room.WithVisitor(visitor, func(v *Visitor) {
+		v.HandRaised = true
+	})
+	if promoted, _ := room.PromoteRaisedHand(audience.ID); !promoted {
+		t.Fatal("the raised hand was not promoted")
+	}
+	if !room.CanPublish(audience) {
+		t.Error("a promoted presenter can not publish into a webinar")
+	}
+}
+
+// TestOpenRoomConcurrently opens a room that is not in the cache from many goroutines at once,
+// by id and by slug, and expects them all to end up in the same room
+func TestOpenRoomConcurrently(t *testing.T) {
+	s := newTestService(t)
+	created := s.createRoom(t)
+	slug := created.Metadata().Slug
+	s.CloseRoom(created, "evicted")
+
+	const openers = 20
+	opened := make(chan *ChatRoom, openers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < openers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			var room *ChatRoom
+			var err error
+			if i%2 == 0 {
+				room, err = s.GetRoomByID(created.ID)
+			} else {
+				room, err = s.GetRoomBySlug(slug)
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			opened <- room
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(opened)
+
+	cached, err := s.cache.GetRoom(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseRoom(cached, "test over")
+	for room := range opened {
+		if room != cached {
+			t.Fatal("the room was opened more than once")
+		}
+	}
+	if cached == created {
+		t.Error("the closed room was handed out again")
+	}
+}
+
+// TestGetOrOpenOpensOnce has everyone who asks for a room while it is being opened wait for it
+func TestGetOrOpenOpensOnce(t *testing.T) {
+	cache := &RoomsCache{table: RoomsTable{}, slugs: map[string]uint{}}
+	var mu sync.Mutex
+	opens := 0
+	open := func() (*ChatRoom, error) {
+		mu.Lock()
+		opens++
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		return &ChatRoom{ID: 1}, nil
+	}
+
+	const openers = 10
+	rooms := make(chan *ChatRoom, openers)
+	var wg sync.WaitGroup
+	for i := 0; i < openers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			room, _, err := cache.GetOrOpen(1, open)
+			if err != nil {
+				t.Error(err)
+			}
+			rooms <- room
+		}()
+	}
+	wg.Wait()
+	close(rooms)
+
+	if opens != 1 {
+		t.Errorf("the room was opened %d times", opens)
+	}
+	first := <-rooms
+	for room := range rooms {
+		if room != first {
+			t.Error("callers were handed different rooms")
+		}
+	}
+
+	failed := errors.New("no such room")
+	if _, opened, err := cache.GetOrOpen(2, func() (*ChatRoom, error) { return nil, failed }); err != failed || opened {
+		t.Errorf("a room that failed to open: opened %v, %v", opened, err)
+	}
+	if _, err := cache.GetRoom(2); err == nil {
+		t.Error("a room that failed to open was cached")
+	}
+}
+
+// TestCloseRoomClosesSockets cuts off everyone still in a room, or its lobby, when it closes
+func TestCloseRoomClosesSockets(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	visitor := s.joinChat(t, room)
+
+	metadata := room.Metadata()
+	metadata.Settings.LobbyEnabled = true
+	room.SetMetadata(metadata)
+	waiting := NewVisitor(newTestClient(t), nil, room)
+	if err := room.AddVisitor(waiting, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s.CloseRoom(room, "test over")
+	for _, v := range []*Visitor{visitor, waiting} {
+		if err := v.Notify(&types.Event{Event: "test"}); !errors.Is(err, websocketClient.ErrClientClosed) {
+			t.Errorf("a socket was left open on a closed room: %v", err)
+		}
+	}
+}
+
+// TestEvictIdleRoomsOff returns straight away when idle eviction is turned off, rather than panic on a zero interval
+func TestEvictIdleRoomsOff(t *testing.T) {
+	s := &ChatRoomsService{cfg: config.Defaults()}
+	s.cfg.RoomIdleTimeout = 0
+	s.evictIdleRooms(context.Background())
+}
@@ -2,77 +2,302 @@ package rooms
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/Embiggenerd/spiritio/pkg/config"
 	"github.com/Embiggenerd/spiritio/pkg/db"
 	"github.com/Embiggenerd/spiritio/pkg/logger"
+	"github.com/Embiggenerd/spiritio/pkg/users"
 	"github.com/Embiggenerd/spiritio/types"
+	"gorm.io/gorm"
 )
 
 func NewRoomsService(ctx context.Context, cfg *config.Config, log logger.Logger, db *db.Database) RoomsService {
 	db.DB.AutoMigrate(&ChatRoom{})
 	db.DB.AutoMigrate(&ChatRoomLog{})
+	db.DB.AutoMigrate(&ChatLogEdit{})
+	db.DB.AutoMigrate(&MessageReaction{})
 	db.DB.AutoMigrate(&Visitor{})
+	db.DB.AutoMigrate(&RoomRole{})
+	db.DB.AutoMigrate(&RoomBan{})
+	db.DB.AutoMigrate(&RoomAdmission{})
+	db.DB.AutoMigrate(&RoomInvite{})
+	db.DB.AutoMigrate(&RoomInviteUse{})
+	db.DB.AutoMigrate(&RoomInvitee{})
 	roomsTable := make(RoomsTable)
 	rooms := &ChatRoomsService{
-		cfg:         cfg,
-		cache:       &RoomsCache{table: roomsTable},
-		DB:          db,
-		RoomStorage: &RoomStorage{db: db},
-		ChatStorage: &ChatLogStorage{db: db},
+		cfg:               cfg,
+		log:               log,
+		cache:             &RoomsCache{table: roomsTable, slugs: map[string]uint{}},
+		DB:                db,
+		RoomStorage:       &RoomStorage{db: db},
+		ChatStorage:       &ChatLogStorage{db: db},
+		RoleStorage:       &RoleStorage{db: db},
+		BanStorage:        &BanStorage{db: db},
+		LobbyStorage:      &LobbyStorage{db: db},
+		InviteStorage:     &InviteStorage{db: db},
+		ScheduleStorage:   &ScheduleStorage{db: db},
+		AttendanceStorage: &AttendanceStorage{db: db},
+		ReactionStorage:   &ReactionStorage{db: db},
+		SearchStorage:     &SearchStorage{db: db},
 	}
+	rooms.backfillSlugs()
+	if !fts5Built {
+		// The index's triggers run on every message saved, and fail without FTS5
+		if rooms.SearchStorage.HasSearchIndex() {
+			log.Fatal("this database has a message search index, so the server must be built with the sqlite_fts5 tag")
+		}
+		log.Info("message search is off: the server was built without the sqlite_fts5 tag")
+	} else if err := rooms.SearchStorage.EnsureSearchIndex(); err != nil {
+		log.Error("message search is off: " + err.Error())
+	} else {
+		rooms.searchReady = true
+	}
+	if err := rooms.ChatStorage.BackfillSeqs(); err != nil {
+		log.Error(err.Error())
+	}
+	rooms.OnOccupancyChanged(rooms.reportBreakoutOccupancy)
+	go rooms.evictIdleRooms(ctx)
 	return rooms
 }
 
 type RoomsService interface {
-	CreateRoom(ctx context.Context) (*ChatRoom, error)
+	CreateRoom(ctx context.Context, createdByID uint) (*ChatRoom, error)
 	GetRoomByID(roomID uint) (*ChatRoom, error)
-	SaveChatLog(msg types.UserMessageData, visitor *Visitor) error
+	GetRoomBySlug(slug string) (*ChatRoom, error)
+	SetSlug(room *ChatRoom, slug string) error
+	SaveChatLog(msg types.UserMessageData, visitor *Visitor) (types.UserMessageData, bool, error)
+	ChatHistory(visitor *Visitor, before, after uint, limit int) (types.ChatHistoryData, error)
+	Thread(visitor *Visitor, messageID, after uint, limit int) (types.ThreadData, error)
+	SearchMessages(user *users.User, query SearchQuery) (types.MessageSearchData, error)
+	EditMessage(visitor *Visitor, id uint, text string) (types.UserMessageData, error)
+	DeleteMessage(visitor *Visitor, id uint) (types.UserMessageData, error)
+	AddReaction(visitor *Visitor, messageID uint, emoji string) (types.UserMessageData, error)
+	RemoveReaction(visitor *Visitor, messageID uint, emoji string) (types.UserMessageData, error)
+	SetRoomMode(room *ChatRoom, mode string) error
+	UpdateRoom(room *ChatRoom, update types.UpdateRoomWorkOrderDetail) error
+	SetRole(room *ChatRoom, userID uint, role Role) error
+	BanUser(room *ChatRoom, ban *RoomBan) error
+	UnbanUser(room *ChatRoom, userID uint) error
+	Bans(room *ChatRoom) ([]RoomBan, error)
+	CheckBan(roomID, userID uint) error
+	AdmitUser(room *ChatRoom, userID uint) (*users.User, error)
+	CreateInvite(room *ChatRoom, createdByID uint, role Role, expiresIn time.Duration, maxUses int) (string, *RoomInvite, error)
+	CalendarInvite(room *ChatRoom, createdByID uint, expiresIn time.Duration) (string, error)
+	CheckAccess(room *ChatRoom, passcode, invite string, userID uint) error
+	RedeemInvite(room *ChatRoom, invite string, userID uint) (Role, error)
+	SetSchedule(room *ChatRoom, detail types.SetScheduleWorkOrderDetail) error
+	Invitees(room *ChatRoom) ([]string, error)
+	CreateBreakouts(ctx context.Context, parent *ChatRoom, createdByID uint, detail types.CreateBreakoutsWorkOrderDetail) error
+	RecallBreakouts(parent *ChatRoom, countdown time.Duration) error
+	Breakouts(parent *ChatRoom) types.BreakoutsData
+	Attendance(room *ChatRoom, query AttendanceQuery) ([]types.AttendanceData, error)
+	CloseRoom(room *ChatRoom, reason string)
+	OnRoomOpened(hook RoomHook)
+	OnRoomClosed(hook RoomHook)
+	OnOccupancyChanged(hook RoomHook)
+	Directory(query string) ([]types.DirectoryRoomData, error)
+	DirectoryEntry(room *ChatRoom) types.DirectoryRoomData
 }
 
 type ChatRoomsService struct {
-	cache       Cache
-	DB          *db.Database
-	RoomStorage RoomStore
-	ChatStorage ChatLogStore
-	cfg         *config.Config
+	cache             Cache
+	DB                *db.Database
+	RoomStorage       RoomStore
+	ChatStorage       ChatLogStore
+	RoleStorage       RoleStore
+	BanStorage        BanStore
+	LobbyStorage      LobbyStore
+	InviteStorage     InviteStore
+	ScheduleStorage   ScheduleStore
+	AttendanceStorage AttendanceStore
+	ReactionStorage   ReactionStore
+	SearchStorage     SearchStore
+	// searchReady is set once the full text index is in place
+	searchReady    bool
+	cfg            *config.Config
+	log            logger.Logger
+	hooksMu        sync.Mutex
+	openedHooks    []RoomHook
+	closedHooks    []RoomHook
+	occupancyHooks []RoomHook
 }
 
-// CreateRoom creates a new room
-func (r *ChatRoomsService) CreateRoom(ctx context.Context) (*ChatRoom, error) {
-	newRoom, err := r.RoomStorage.CreateRoom(ctx)
+// CreateRoom creates a new room. Its creator becomes its owner when they first sign in to it.
+func (r *ChatRoomsService) CreateRoom(ctx context.Context, createdByID uint) (*ChatRoom, error) {
+	slug, err := r.newSlug()
+	if err != nil {
+		return nil, err
+	}
+	newRoom, err := r.RoomStorage.CreateRoom(ctx, slug, createdByID)
 	if err != nil {
 		return newRoom, err
 	}
 
-	newRoom.Build(ctx, r)
+	if err := newRoom.Build(ctx, r); err != nil {
+		return nil, err
+	}
 
 	r.cache.AddRoom(newRoom)
+	r.runHooks(r.openedHooks, newRoom)
 	return newRoom, err
 }
 
 func (r *ChatRoomsService) GetRoomByID(roomID uint) (*ChatRoom, error) {
-	room, err := r.cache.GetRoom(roomID)
-	if err != nil {
-		room, err = r.RoomStorage.FindRoomByID(roomID)
+	return r.getOrOpen(roomID, func() (*ChatRoom, error) {
+		room, err := r.RoomStorage.FindRoomByID(roomID)
 		if err != nil {
 			return room, err
 		}
-		chatLog, _ := r.ChatStorage.GetChatLogsByRoomID(roomID)
-		room.ChatLog = chatLog
-		room.Build(context.TODO(), r)
-		r.cache.AddRoom(room)
+		return room, r.openRoom(room)
+	})
+}
+
+// getOrOpen returns an open room from the cache, or opens it with open. Rooms are only ever opened once at a time,
+// so everyone who joins a room meanwhile ends up in the same one.
+func (r *ChatRoomsService) getOrOpen(roomID uint, open func() (*ChatRoom, error)) (*ChatRoom, error) {
+	room, opened, err := r.cache.GetOrOpen(roomID, open)
+	if opened {
+		r.runHooks(r.openedHooks, room)
 	}
 	return room, err
 }
 
-func (s *ChatRoomsService) SaveChatLog(msg types.UserMessageData, visitor *Visitor) error {
+// openRoom loads a stored room's chat log and roles and starts it
+func (r *ChatRoomsService) openRoom(room *ChatRoom) error {
+	// One extra message tells whether there is history beyond the window
+	window := r.cfg.ChatWindowSize
+	chatLog, _ := r.ChatStorage.GetChatLogWindow(room.ID, window+1)
+	if len(chatLog) > window {
+		chatLog = chatLog[1:]
+		room.chatHasMore = true
+	}
+	room.chatLog = chatLog
+	lastSeq, err := r.ChatStorage.LastSeq(room.ID)
+	if err != nil {
+		r.log.Error(err.Error())
+	}
+	room.lastSeq = lastSeq
+	roles, _ := r.RoleStorage.GetRolesByRoomID(room.ID)
+	room.roles = map[uint]Role{}
+	for _, role := range roles {
+		room.roles[role.UserID] = role.Role
+	}
+	breakouts, _ := r.RoomStorage.FindBreakouts(room.ID)
+	for i := range breakouts {
+		room.breakouts = append(room.breakouts, breakouts[i].ID)
+	}
+	return room.Build(context.TODO(), r)
+}
+
+// SetRoomMode switches a room between meeting and webinar mode
+func (s *ChatRoomsService) SetRoomMode(room *ChatRoom, mode string) error {
+	if mode != RoomModeMeeting && mode != RoomModeWebinar {
+		return fmt.Errorf("room mode must be %s or %s", RoomModeMeeting, RoomModeWebinar)
+	}
+	if err := s.RoomStorage.UpdateRoomMode(room.ID, mode); err != nil {
+		return err
+	}
+	// The audience stops publishing once a room becomes a webinar
+	for _, pc := range room.SetMode(mode) {
+		if err := room.SFU.DisablePublishing(pc); err != nil {
+			s.log.Error(err.Error())
+		}
+	}
+	return nil
+}
+
+// UpdateRoom applies an update_room work order to a room's metadata and persists it
+func (s *ChatRoomsService) UpdateRoom(room *ChatRoom, update types.UpdateRoomWorkOrderDetail) error {
+	metadata := room.Metadata()
+	if err := metadata.apply(update); err != nil {
+		return err
+	}
+	if err := s.RoomStorage.UpdateRoomMetadata(room.ID, metadata); err != nil {
+		return err
+	}
+	room.SetMetadata(metadata)
+
+	// Nobody is left waiting once the lobby is turned off
+	if !metadata.Settings.LobbyEnabled {
+		room.AdmitAll()
+	}
+	room.OccupancyChanged()
+	return nil
+}
+
+// claimRoom makes a room's creator its owner when they sign in, if nobody owns it yet
+func (s *ChatRoomsService) claimRoom(room *ChatRoom, userID uint) {
+	if !room.claim(userID) {
+		return
+	}
+	if err := s.RoomStorage.UpdateRoomMetadata(room.ID, room.Metadata()); err != nil {
+		s.log.Error(err.Error())
+		return
+	}
+	room.BroadcastEvent(&types.Event{Event: "room_updated", Data: room.RoomData()})
+	room.BroadcastEvent(&types.Event{Event: "roles_updated", Data: room.Roles()})
+}
 
-	chatLog := new(ChatRoomLog)
-	chatLog.UserMessageData = msg
-	chatLog.RoomID = visitor.Room.ID
+// SetRole gives a user a role in a room. The room's owner keeps their role.
+func (s *ChatRoomsService) SetRole(room *ChatRoom, userID uint, role Role) error {
+	if userID == 0 {
+		return errors.New("a user id is required")
+	}
+	if userID == room.Metadata().OwnerID {
+		return errors.New("the room's owner can not be given another role")
+	}
+	if role == RoleOwner {
+		return ErrOwnerRole
+	}
+	if err := s.RoleStorage.SaveRole(&RoomRole{RoomID: room.ID, UserID: userID, Role: role}); err != nil {
+		return err
+	}
+	room.setRole(userID, role)
+	return nil
+}
 
-	chatRoomLog, err := s.ChatStorage.SaveChatlog(chatLog)
-	s.cache.UpdateChatLogs(visitor.Room.ID, chatRoomLog)
-	return err
+// BanUser persists a ban. Kicking the user out of the room is left to the caller.
+func (s *ChatRoomsService) BanUser(room *ChatRoom, ban *RoomBan) error {
+	if ban.UserID == 0 {
+		return errors.New("a user id is required")
+	}
+	ban.RoomID = room.ID
+	ban.CreatedAt = time.Now()
+	if ban.ExpiresAt != nil && !ban.ExpiresAt.After(ban.CreatedAt) {
+		return errors.New("a ban must expire in the future")
+	}
+	return s.BanStorage.SaveBan(ban)
+}
+
+// UnbanUser revokes a user's ban from a room
+func (s *ChatRoomsService) UnbanUser(room *ChatRoom, userID uint) error {
+	found, err := s.BanStorage.DeleteBan(room.ID, userID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("user is not banned")
+	}
+	return nil
+}
+
+// Bans lists a room's bans that have not expired
+func (s *ChatRoomsService) Bans(room *ChatRoom) ([]RoomBan, error) {
+	return s.BanStorage.GetActiveBansByRoomID(room.ID)
+}
+
+// CheckBan returns ErrBanned if the user has an active ban from the room
+func (s *ChatRoomsService) CheckBan(roomID, userID uint) error {
+	_, err := s.BanStorage.FindActiveBan(roomID, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ErrBanned
 }
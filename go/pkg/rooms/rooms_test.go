@@ -0,0 +1,100 @@
+package rooms
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Embiggenerd/spiritio/pkg/config"
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"github.com/Embiggenerd/spiritio/pkg/logger"
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/pkg/utils"
+	"github.com/Embiggenerd/spiritio/pkg/websocketClient"
+	"github.com/gorilla/websocket"
+)
+
+// testService is a rooms service backed by a fresh database in a temporary directory
+type testService struct {
+	*ChatRoomsService
+	users users.Users
+	ctx   context.Context
+}
+
+func newTestService(t *testing.T) *testService {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Defaults()
+	log := &logger.CustomLogger{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	return &testService{
+		ChatRoomsService: NewRoomsService(ctx, cfg, log, database).(*ChatRoomsService),
+		users:            users.NewUsersService(ctx, cfg, log, database),
+		ctx:              ctx,
+	}
+}
+
+func (s *testService) createRoom(t *testing.T) *ChatRoom {
+	t.Helper()
+	room, err := s.CreateRoom(s.ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return room
+}
+
+func (s *testService) createUser(t *testing.T) *users.User {
+	t.Helper()
+	user, _, err := s.users.CreateUser(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// newTestClient connects a websocket whose every message the far end reads and throws away
+func newTestClient(t *testing.T) *websocketClient.WebsocketClient {
+	t.Helper()
+	ctx := utils.WithMetadata(context.Background())
+	utils.ExposeContextMetadata(ctx).Set("requestID", "test")
+	log := &logger.CustomLogger{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	clients := make(chan *websocketClient.WebsocketClient, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := websocketClient.New(ctx, log, w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		clients <- client
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	client := <-clients
+	t.Cleanup(client.Close)
+	return client
+}
@@ -0,0 +1,377 @@
+package rooms
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+const (
+	RoomClosedScheduleEnded = "schedule_ended"
+
+	// scheduleCheckInterval is how often rooms check whether their meeting has started or ended
+	scheduleCheckInterval = 5 * time.Second
+	// scheduleWarning is how long before a scheduled end hosts are warned
+	scheduleWarning = 5 * time.Minute
+	// maxOccurrences bounds how far a recurrence rule is walked
+	maxOccurrences = 10000
+	maxInvitees    = 100
+)
+
+// RoomSchedule is when a room's meeting happens. A room without a start time has no schedule.
+type RoomSchedule struct {
+	StartsAt *time.Time
+	EndsAt   *time.Time
+	// Recurrence is an iCalendar RRULE such as FREQ=WEEKLY;INTERVAL=2;COUNT=10
+	Recurrence string
+	// InviteID is the invite in the schedule's calendar file, which every download of it shares
+	InviteID string
+}
+
+// RoomInvitee is someone a scheduled meeting is meant for, who is listed in its calendar file
+type RoomInvitee struct {
+	ID     uint   `gorm:"primaryKey"`
+	RoomID uint   `gorm:"uniqueIndex:idx_room_invitee"`
+	Email  string `gorm:"uniqueIndex:idx_room_invitee"`
+}
+
+// recurrence is the part of RRULE that schedules support
+type recurrence struct {
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+}
+
+func parseRecurrence(rule string) (*recurrence, error) {
+	rec := &recurrence{interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(rule), "RRULE:"), ";") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "FREQ":
+			if value != "DAILY" && value != "WEEKLY" && value != "MONTHLY" {
+				return nil, fmt.Errorf("recurrence frequency %q is not supported", value)
+			}
+			rec.freq = value
+		case "INTERVAL", "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("recurrence %s must be a positive number", strings.ToLower(key))
+			}
+			if key == "INTERVAL" {
+				rec.interval = n
+			} else {
+				rec.count = n
+			}
+		case "UNTIL":
+			until, err := parseICSTime(value)
+			if err != nil {
+				return nil, errors.New("recurrence until must look like 20060102T150405Z")
+			}
+			rec.until = until
+		default:
+			return nil, fmt.Errorf("recurrence part %q is not supported", part)
+		}
+	}
+	if rec.freq == "" {
+		return nil, errors.New("recurrence needs a FREQ")
+	}
+	if rec.count > 0 && !rec.until.IsZero() {
+		return nil, errors.New("recurrence can not have both COUNT and UNTIL")
+	}
+	return rec, nil
+}
+
+func parseICSTime(value string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	return time.Parse("20060102", value)
+}
+
+// nth returns the start of the nth occurrence after first
+func (rec *recurrence) nth(first time.Time, n int) time.Time {
+	switch rec.freq {
+	case "DAILY":
+		return first.AddDate(0, 0, n*rec.interval)
+	case "WEEKLY":
+		return first.AddDate(0, 0, 7*n*rec.interval)
+	default:
+		return first.AddDate(0, n*rec.interval, 0)
+	}
+}
+
+// within reports whether the nth occurrence, starting at start, is part of the rule
+func (rec *recurrence) within(n int, start time.Time) bool {
+	if rec.count > 0 && n >= rec.count {
+		return false
+	}
+	return rec.until.IsZero() || !start.After(rec.until)
+}
+
+// Scheduled reports whether the room has a schedule
+func (s RoomSchedule) Scheduled() bool {
+	return s.StartsAt != nil
+}
+
+// Occurrence returns the meeting that is happening at now, or the next one if none is.
+// The end is zero for meetings without one. ok is false once every meeting is over.
+func (s RoomSchedule) Occurrence(now time.Time) (start, end time.Time, ok bool) {
+	if s.StartsAt == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	if s.Recurrence == "" {
+		if s.EndsAt != nil {
+			end = *s.EndsAt
+			if !now.Before(end) {
+				return time.Time{}, time.Time{}, false
+			}
+		}
+		return *s.StartsAt, end, true
+	}
+
+	rec, err := parseRecurrence(s.Recurrence)
+	if err != nil || s.EndsAt == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	length := s.EndsAt.Sub(*s.StartsAt)
+	for n := 0; n < maxOccurrences; n++ {
+		start = rec.nth(*s.StartsAt, n)
+		if !rec.within(n, start) {
+			break
+		}
+		if now.Before(start.Add(length)) {
+			return start, start.Add(length), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// LastEnd returns when the final meeting ends. ok is false for schedules that go on forever or have no end.
+func (s RoomSchedule) LastEnd() (last time.Time, ok bool) {
+	if s.StartsAt == nil || s.EndsAt == nil {
+		return time.Time{}, false
+	}
+	if s.Recurrence == "" {
+		return *s.EndsAt, true
+	}
+
+	rec, err := parseRecurrence(s.Recurrence)
+	if err != nil || (rec.count == 0 && rec.until.IsZero()) {
+		return time.Time{}, false
+	}
+	length := s.EndsAt.Sub(*s.StartsAt)
+	for n := 0; n < maxOccurrences; n++ {
+		start := rec.nth(*s.StartsAt, n)
+		if !rec.within(n, start) {
+			break
+		}
+		last = start.Add(length)
+	}
+	return last, true
+}
+
+// Data describes the schedule to clients
+func (s RoomSchedule) Data() types.ScheduleData {
+	return types.ScheduleData{
+		StartsAt:   s.StartsAt,
+		EndsAt:     s.EndsAt,
+		Recurrence: s.Recurrence,
+	}
+}
+
+// newSchedule checks a set_schedule work order and turns it into a schedule and a list of invitees
+func newSchedule(detail types.SetScheduleWorkOrderDetail) (RoomSchedule, []string, error) {
+	schedule := RoomSchedule{StartsAt: detail.StartsAt, EndsAt: detail.EndsAt, Recurrence: strings.ToUpper(strings.TrimSpace(detail.Recurrence))}
+	if schedule.StartsAt == nil {
+		if schedule.EndsAt != nil || schedule.Recurrence != "" {
+			return RoomSchedule{}, nil, errors.New("a schedule needs a start time")
+		}
+		return RoomSchedule{}, nil, nil
+	}
+	if schedule.EndsAt != nil && !schedule.EndsAt.After(*schedule.StartsAt) {
+		return RoomSchedule{}, nil, errors.New("a schedule must end after it starts")
+	}
+	if schedule.Recurrence != "" {
+		if schedule.EndsAt == nil {
+			return RoomSchedule{}, nil, errors.New("a recurring schedule needs an end time")
+		}
+		if _, err := parseRecurrence(schedule.Recurrence); err != nil {
+			return RoomSchedule{}, nil, err
+		}
+	}
+
+	if len(detail.Invitees) > maxInvitees {
+		return RoomSchedule{}, nil, fmt.Errorf("a schedule can have at most %d invitees", maxInvitees)
+	}
+	invitees := []string{}
+	seen := map[string]bool{}
+	for _, invitee := range detail.Invitees {
+		address, err := mail.ParseAddress(invitee)
+		if err != nil {
+			return RoomSchedule{}, nil, fmt.Errorf("invitee %q is not an email address", invitee)
+		}
+		email := strings.ToLower(address.Address)
+		if !seen[email] {
+			seen[email] = true
+			invitees = append(invitees, email)
+		}
+	}
+	return schedule, invitees, nil
+}
+
+// NotStarted returns when the room's meeting starts, if visitors are being held until then
+func (r *ChatRoom) NotStarted() (time.Time, bool) {
+	var startsAt time.Time
+	held := false
+	r.do(func() {
+		startsAt, held = r.notStarted(time.Now())
+	})
+	return startsAt, held
+}
+
+// Holding reports whether newcomers are kept waiting, in the lobby or until the meeting starts
+func (r *ChatRoom) Holding() bool {
+	holding := false
+	r.do(func() {
+		holding = r.holding()
+	})
+	return holding
+}
+
+func (r *ChatRoom) holding() bool {
+	_, held := r.notStarted(time.Now())
+	return held || r.Settings.LobbyEnabled
+}
+
+func (r *ChatRoom) notStarted(now time.Time) (time.Time, bool) {
+	start, _, ok := r.Schedule.Occurrence(now)
+	if !ok || !now.Before(start) {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// SetSchedule replaces a room's schedule and invitees
+func (s *ChatRoomsService) SetSchedule(room *ChatRoom, detail types.SetScheduleWorkOrderDetail) error {
+	schedule, invitees, err := newSchedule(detail)
+	if err != nil {
+		return err
+	}
+
+	metadata := room.Metadata()
+	metadata.Schedule = schedule
+	if err := s.RoomStorage.UpdateRoomMetadata(room.ID, metadata); err != nil {
+		return err
+	}
+	if err := s.ScheduleStorage.SaveInvitees(room.ID, invitees); err != nil {
+		return err
+	}
+	room.do(func() {
+		room.RoomMetadata = metadata
+		// The next check starts over from the new schedule
+		room.occurrenceStart = time.Time{}
+		room.occurrenceEnd = time.Time{}
+		room.warnedFor = time.Time{}
+	})
+	return nil
+}
+
+// Invitees lists the email addresses a room's meeting is meant for
+func (s *ChatRoomsService) Invitees(room *ChatRoom) ([]string, error) {
+	invitees, err := s.ScheduleStorage.GetInviteesByRoomID(room.ID)
+	emails := []string{}
+	for _, invitee := range invitees {
+		emails = append(emails, invitee.Email)
+	}
+	return emails, err
+}
+
+// checkSchedule lets held visitors in when a meeting starts, warns hosts before it ends and closes the room when it does
+func (s *ChatRoomsService) checkSchedule(room *ChatRoom) {
+	now := time.Now()
+	var start, end time.Time
+	started, ending, over := false, false, false
+	room.do(func() {
+		if !room.occurrenceEnd.IsZero() && !now.Before(room.occurrenceEnd) {
+			over = true
+			return
+		}
+		var ok bool
+		start, end, ok = room.Schedule.Occurrence(now)
+		if !ok || now.Before(start) {
+			return
+		}
+		if !room.occurrenceStart.Equal(start) {
+			room.occurrenceStart, room.occurrenceEnd = start, end
+			started = true
+		}
+		if !end.IsZero() && !now.Before(end.Add(-scheduleWarning)) && !room.warnedFor.Equal(start) {
+			room.warnedFor = start
+			ending = true
+		}
+	})
+
+	if over {
+		s.CloseRoom(room, RoomClosedScheduleEnded)
+		return
+	}
+	if started {
+		event := &types.Event{Event: "meeting_started", Data: meetingData(room.ID, start, end)}
+		s.releaseHeld(room, event)
+		room.BroadcastEvent(event)
+	}
+	if ending {
+		room.NotifyPermitted(PermEditRoom, &types.Event{Event: "meeting_ending", Data: meetingData(room.ID, start, end)})
+	}
+}
+
+func meetingData(roomID uint, start, end time.Time) types.MeetingData {
+	data := types.MeetingData{RoomID: roomID, StartsAt: start}
+	if !end.IsZero() {
+		data.EndsAt = &end
+	}
+	return data
+}
+
+// releaseHeld moves visitors held before the meeting started through the lobby as if they had just arrived.
+// Without a lobby everyone held is let in, signed in or not. With one, those who have not signed in are
+// told the meeting started, and go through the lobby when they sign in.
+func (s *ChatRoomsService) releaseHeld(room *ChatRoom, started *types.Event) {
+	if !room.Metadata().Settings.LobbyEnabled {
+		room.AdmitAll()
+		return
+	}
+	room.do(func() {
+		for _, v := range room.lobby {
+			if v.User == nil {
+				v.Notify(started)
+			}
+		}
+	})
+	for _, user := range room.lobbyUsers() {
+		s.enterLobby(room, user)
+	}
+}
+
+// lobbyUsers returns a copy of each signed in user waiting in the lobby
+func (r *ChatRoom) lobbyUsers() []*users.User {
+	waiting := []*users.User{}
+	r.do(func() {
+		seen := map[uint]bool{}
+		for _, v := range r.lobby {
+			if v.User != nil && !seen[v.User.ID] {
+				seen[v.User.ID] = true
+				user := *v.User
+				waiting = append(waiting, &user)
+			}
+		}
+	})
+	return waiting
+}
@@ -0,0 +1,36 @@
+package rooms
+
+import (
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"gorm.io/gorm"
+)
+
+type ScheduleStore interface {
+	SaveInvitees(roomID uint, emails []string) error
+	GetInviteesByRoomID(roomID uint) ([]RoomInvitee, error)
+}
+
+type ScheduleStorage struct {
+	db *db.Database
+}
+
+// SaveInvitees replaces a room's invitees
+func (s *ScheduleStorage) SaveInvitees(roomID uint, emails []string) error {
+	return s.db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("room_id = ?", roomID).Delete(&RoomInvitee{}).Error; err != nil {
+			return err
+		}
+		for _, email := range emails {
+			if err := tx.Create(&RoomInvitee{RoomID: roomID, Email: email}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *ScheduleStorage) GetInviteesByRoomID(roomID uint) ([]RoomInvitee, error) {
+	invitees := []RoomInvitee{}
+	result := s.db.DB.Where("room_id = ?", roomID).Order("id").Find(&invitees)
+	return invitees, result.Error
+}
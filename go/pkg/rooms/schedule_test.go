@@ -0,0 +1,111 @@
+package rooms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+func setSchedule(t *testing.T, s *testService, room *ChatRoom, startsAt, endsAt time.Time) {
+	t.Helper()
+	if err := s.SetSchedule(room, types.SetScheduleWorkOrderDetail{StartsAt: &startsAt, EndsAt: &endsAt}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCalendarInviteIsShared(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	host := s.createUser(t)
+
+	now := time.Now()
+	setSchedule(t, s, room, now.Add(time.Hour), now.Add(2*time.Hour))
+	first, err := s.CalendarInvite(room, host.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.CalendarInvite(room, host.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("downloading the calendar again made a new invite")
+	}
+
+	setSchedule(t, s, room, now.Add(3*time.Hour), now.Add(4*time.Hour))
+	rescheduled, err := s.CalendarInvite(room, host.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rescheduled == first {
+		t.Error("a new schedule kept the old schedule's invite")
+	}
+	// Calendars sent out for the old schedule still let people in
+	if err := s.CheckAccess(room, "", first, 0); err != nil {
+		t.Errorf("old calendar invite was refused: %v", err)
+	}
+
+	var count int64
+	s.DB.DB.Model(&RoomInvite{}).Where("room_id = ?", room.ID).Count(&count)
+	if count != 2 {
+		t.Errorf("room has %d invites, want one per schedule", count)
+	}
+}
+
+func TestReleaseHeldVisitorsWhoHaveNotSignedIn(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+
+	now := time.Now()
+	setSchedule(t, s, room, now.Add(time.Hour), now.Add(2*time.Hour))
+	visitor := NewVisitor(newTestClient(t), nil, room)
+	if err := room.AddVisitor(visitor, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !visitor.InLobby() {
+		t.Fatal("early arrival was not held")
+	}
+
+	setSchedule(t, s, room, now.Add(-time.Minute), now.Add(time.Hour))
+	s.checkSchedule(room)
+	if visitor.InLobby() {
+		t.Error("early arrival who had not signed in was still held once the meeting started")
+	}
+
+	if err := visitor.AddUser(s.createUser(t)); err != nil {
+		t.Fatal(err)
+	}
+	if len(room.Guests()) != 1 {
+		t.Error("released visitor is not in the room after signing in")
+	}
+}
+
+// TestHolding keeps newcomers, WHEP viewers among them, out until the meeting starts or while the lobby is on
+func TestHolding(t *testing.T) {
+	s := newTestService(t)
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	if room.Holding() {
+		t.Error("a room with no schedule or lobby is holding newcomers")
+	}
+
+	now := time.Now()
+	setSchedule(t, s, room, now.Add(time.Hour), now.Add(2*time.Hour))
+	if !room.Holding() {
+		t.Error("a meeting that has not started is letting newcomers in")
+	}
+
+	setSchedule(t, s, room, now.Add(-time.Minute), now.Add(time.Hour))
+	if room.Holding() {
+		t.Error("a meeting under way is holding newcomers")
+	}
+	metadata := room.Metadata()
+	metadata.Settings.LobbyEnabled = true
+	room.SetMetadata(metadata)
+	if !room.Holding() {
+		t.Error("a room with its lobby on is letting newcomers in")
+	}
+}
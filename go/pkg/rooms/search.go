@@ -0,0 +1,115 @@
+package rooms
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 50
+	maxSearchTerms        = 16
+)
+
+var (
+	ErrSearchUnavailable = errors.New("message search is not available on this server")
+	ErrEmptySearch       = errors.New("search for at least one word")
+	ErrSearchPage        = fmt.Errorf("search page size must be between 1 and %d, from an offset of 0 or more", maxSearchPageSize)
+)
+
+// SearchQuery is a full text search over chat messages. Zero values of the filters match everything.
+type SearchQuery struct {
+	Text     string
+	AuthorID uint
+	RoomSlug string
+	From     time.Time
+	To       time.Time
+	Limit    int
+	Offset   int
+}
+
+// messageMatch is a message found by a search, along with the room it is in
+type messageMatch struct {
+	ID           uint
+	RoomID       uint
+	ParentID     *uint
+	FromUserID   uint
+	FromUserName string
+	ToUserID     uint
+	CreatedAt    time.Time
+	RoomSlug     string
+	RoomName     string
+	Snippet      string
+}
+
+// ftsMatch turns what someone typed into an FTS5 query that finds messages with all of its words.
+// Each word is quoted so FTS5 syntax in it is searched for rather than run, and the last word matches as a prefix.
+func ftsMatch(text string) string {
+	words := strings.Fields(text)
+	if len(words) > maxSearchTerms {
+		words = words[:maxSearchTerms]
+	}
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// highlight escapes a snippet for HTML and marks the matched words, which the index wrapped in \x01 and \x02
+func highlight(snippet string) string {
+	return strings.NewReplacer("\x01", "<mark>", "\x02", "</mark>").Replace(html.EscapeString(snippet))
+}
+
+// SearchMessages searches the messages a user can read across rooms
+func (s *ChatRoomsService) SearchMessages(user *users.User, query SearchQuery) (types.MessageSearchData, error) {
+	if !s.searchReady {
+		return types.MessageSearchData{}, ErrSearchUnavailable
+	}
+	match := ftsMatch(query.Text)
+	if match == "" {
+		return types.MessageSearchData{}, ErrEmptySearch
+	}
+	if query.Limit < 0 || query.Limit > maxSearchPageSize || query.Offset < 0 {
+		return types.MessageSearchData{}, ErrSearchPage
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultSearchPageSize
+	}
+
+	limit := query.Limit
+	query.Limit++
+	matches, err := s.SearchStorage.SearchChatLogs(user.ID, match, query)
+	if err != nil {
+		return types.MessageSearchData{}, err
+	}
+
+	found := types.MessageSearchData{Query: query.Text, Results: []types.MessageSearchResultData{}}
+	if len(matches) > limit {
+		found.HasMore = true
+		matches = matches[:limit]
+	}
+	for _, m := range matches {
+		found.Results = append(found.Results, types.MessageSearchResultData{
+			MessageID:    m.ID,
+			ParentID:     m.ParentID,
+			RoomID:       m.RoomID,
+			RoomSlug:     m.RoomSlug,
+			RoomName:     m.RoomName,
+			FromUserID:   m.FromUserID,
+			FromUserName: m.FromUserName,
+			ToUserID:     m.ToUserID,
+			SentAt:       m.CreatedAt,
+			Snippet:      highlight(m.Snippet),
+		})
+	}
+	return found, nil
+}
@@ -0,0 +1,100 @@
+package rooms
+
+import (
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"gorm.io/gorm"
+)
+
+type SearchStore interface {
+	HasSearchIndex() bool
+	EnsureSearchIndex() error
+	SearchChatLogs(userID uint, match string, query SearchQuery) ([]messageMatch, error)
+}
+
+type SearchStorage struct {
+	db *db.Database
+}
+
+// HasSearchIndex reports whether the full text index has been created
+func (s *SearchStorage) HasSearchIndex() bool {
+	return s.db.DB.Migrator().HasTable("chat_search")
+}
+
+// EnsureSearchIndex creates the full text index over chat_room_logs and the triggers that keep it in
+// step with inserts, edits and soft deletes. Messages saved before the index existed are indexed once.
+// The sqlite driver only has FTS5 when built with the sqlite_fts5 tag, and without it this must not be run.
+func (s *SearchStorage) EnsureSearchIndex() error {
+	return s.db.DB.Transaction(func(tx *gorm.DB) error {
+		if tx.Migrator().HasTable("chat_search") {
+			return nil
+		}
+		statements := []string{
+			`CREATE VIRTUAL TABLE chat_search USING fts5(text, content='chat_room_logs', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`,
+			`CREATE TRIGGER chat_search_insert AFTER INSERT ON chat_room_logs WHEN new.deleted_at IS NULL BEGIN
+				INSERT INTO chat_search(rowid, text) VALUES (new.id, new.text);
+			END`,
+			`CREATE TRIGGER chat_search_update AFTER UPDATE OF text, deleted_at ON chat_room_logs BEGIN
+				INSERT INTO chat_search(chat_search, rowid, text) SELECT 'delete', old.id, old.text WHERE old.deleted_at IS NULL;
+				INSERT INTO chat_search(rowid, text) SELECT new.id, new.text WHERE new.deleted_at IS NULL;
+			END`,
+			`CREATE TRIGGER chat_search_delete AFTER DELETE ON chat_room_logs WHEN old.deleted_at IS NULL BEGIN
+				INSERT INTO chat_search(chat_search, rowid, text) VALUES ('delete', old.id, old.text);
+			END`,
+			`INSERT INTO chat_search(rowid, text) SELECT id, text FROM chat_room_logs WHERE deleted_at IS NULL`,
+		}
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SearchChatLogs finds the messages matching an FTS5 query in rooms the user can read, best matches first.
+// Those are public rooms that need no passcode or invite, and rooms the user owns, has a role in, has
+// been in or has written in, less any they are banned from. Direct messages are only found by their two users.
+func (s *SearchStorage) SearchChatLogs(userID uint, match string, query SearchQuery) ([]messageMatch, error) {
+	now := time.Now()
+	tx := s.db.DB.Table("chat_search").
+		Select(`chat_room_logs.id, chat_room_logs.room_id, chat_room_logs.parent_id, chat_room_logs.from_user_id,
+			chat_room_logs.from_user_name, chat_room_logs.to_user_id, chat_room_logs.created_at,
+			chat_rooms.slug AS room_slug, chat_rooms.name AS room_name,
+			snippet(chat_search, 0, char(1), char(2), '…', 16) AS snippet`).
+		Joins("JOIN chat_room_logs ON chat_room_logs.id = chat_search.rowid").
+		Joins("JOIN chat_rooms ON chat_rooms.id = chat_room_logs.room_id").
+		Where("chat_search MATCH ?", match).
+		Where("chat_room_logs.deleted_at IS NULL").
+		Where(`chat_room_logs.room_id IN (
+			SELECT id FROM chat_rooms WHERE owner_id = ? OR (public AND passcode_hash = '' AND NOT invite_only)
+			UNION SELECT room_id FROM room_roles WHERE user_id = ?
+			UNION SELECT room_id FROM visitors WHERE user_id = ?
+			UNION SELECT room_id FROM chat_room_logs WHERE from_user_id = ?
+		)`, userID, userID, userID, userID).
+		Where(`chat_room_logs.room_id NOT IN (
+			SELECT room_id FROM room_bans WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ?)
+		)`, userID, now).
+		Where("chat_room_logs.to_user_id = 0 OR chat_room_logs.to_user_id = ? OR chat_room_logs.from_user_id = ?", userID, userID)
+
+	if query.AuthorID != 0 {
+		tx = tx.Where("chat_room_logs.from_user_id = ?", query.AuthorID)
+	}
+	if query.RoomSlug != "" {
+		tx = tx.Where("chat_rooms.slug = ?", query.RoomSlug)
+	}
+	if !query.From.IsZero() {
+		tx = tx.Where("chat_room_logs.created_at >= ?", query.From.In(time.Local))
+	}
+	if !query.To.IsZero() {
+		tx = tx.Where("chat_room_logs.created_at <= ?", query.To.In(time.Local))
+	}
+
+	matches := []messageMatch{}
+	result := tx.Order("rank").Order("chat_room_logs.id DESC").
+		Limit(query.Limit).
+		Offset(query.Offset).
+		Scan(&matches)
+	return matches, result.Error
+}
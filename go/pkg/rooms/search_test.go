@@ -0,0 +1,32 @@
+package rooms
+
+import (
+	"testing"
+)
+
+// TestSearchMessages checks search is only on when the driver has FTS5, and that chat keeps working either way
+func TestSearchMessages(t *testing.T) {
+	s := newTestService(t)
+	if s.searchReady != fts5Built {
+		t.Fatalf("search ready is %v in a build where FTS5 is %v", s.searchReady, fts5Built)
+	}
+	room := s.createRoom(t)
+	defer s.CloseRoom(room, "test over")
+	visitor := s.joinChat(t, room)
+	s.say(t, visitor, "the quick brown fox", 0)
+	s.say(t, visitor, "a lazy dog", 0)
+
+	found, err := s.SearchMessages(visitor.User, SearchQuery{Text: "qui"})
+	if !fts5Built {
+		if err != ErrSearchUnavailable {
+			t.Errorf("searching without FTS5: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Results) != 1 || found.Results[0].Snippet != "the <mark>quick</mark> brown fox" {
+		t.Errorf("found %+v, want the message about the fox", found.Results)
+	}
+}
@@ -0,0 +1,106 @@
+package rooms
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/Embiggenerd/spiritio/pkg/utils"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRoomNotFound = errors.New("room_not_found")
+	ErrSlugTaken    = errors.New("that room name is taken")
+	ErrInvalidSlug  = errors.New("room names must be 3 to 40 lowercase letters, numbers or dashes")
+)
+
+var vanitySlug = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,38}[a-z0-9]$`)
+
+// GetRoomBySlug finds a room by the slug in its URL
+func (r *ChatRoomsService) GetRoomBySlug(slug string) (*ChatRoom, error) {
+	room, err := r.cache.GetRoomBySlug(slug)
+	if err == nil {
+		return room, nil
+	}
+
+	room, err = r.RoomStorage.FindRoomBySlug(slug)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// It may have been loaded by ID in the meantime, in which case that room is used and this one is dropped
+	return r.getOrOpen(room.ID, func() (*ChatRoom, error) {
+		return room, r.openRoom(room)
+	})
+}
+
+// SetSlug gives a room a vanity slug in place of its generated one
+func (r *ChatRoomsService) SetSlug(room *ChatRoom, slug string) error {
+	if !vanitySlug.MatchString(slug) {
+		return ErrInvalidSlug
+	}
+	taken, err := r.slugTaken(slug)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrSlugTaken
+	}
+
+	metadata := room.Metadata()
+	oldSlug := metadata.Slug
+	metadata.Slug = slug
+	if err := r.RoomStorage.UpdateRoomMetadata(room.ID, metadata); err != nil {
+		return err
+	}
+	room.SetMetadata(metadata)
+	r.cache.RenameRoom(room.ID, oldSlug, slug)
+	room.OccupancyChanged()
+	return nil
+}
+
+// newSlug generates a slug no other room has
+func (r *ChatRoomsService) newSlug() (string, error) {
+	for i := 0; i < 5; i++ {
+		slug := utils.RandSlug()
+		taken, err := r.slugTaken(slug)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+	}
+	return "", errors.New("could not generate a unique room slug")
+}
+
+func (r *ChatRoomsService) slugTaken(slug string) (bool, error) {
+	_, err := r.RoomStorage.FindRoomBySlug(slug)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// backfillSlugs gives rooms created before slugs existed one of their own
+func (r *ChatRoomsService) backfillSlugs() {
+	rooms, err := r.RoomStorage.FindRoomsWithoutSlugs()
+	if err != nil {
+		r.log.Error(err.Error())
+		return
+	}
+	for i := range rooms {
+		slug, err := r.newSlug()
+		if err != nil {
+			r.log.Error(err.Error())
+			return
+		}
+		metadata := rooms[i].RoomMetadata
+		metadata.Slug = slug
+		if err := r.RoomStorage.UpdateRoomMetadata(rooms[i].ID, metadata); err != nil {
+			r.log.Error(err.Error())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package rooms
+
+import (
+	"errors"
+
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+var (
+	ErrNestedReply = errors.New("replies can not have replies of their own, reply to the thread instead")
+	ErrReplyTarget = errors.New("a reply goes to everyone who can see the message it replies to")
+)
+
+// threadParent finds a message the visitor can reply to
+func (s *ChatRoomsService) threadParent(visitor *Visitor, id uint) (*ChatRoomLog, error) {
+	parent, err := s.visibleChatLog(visitor, id)
+	if err != nil {
+		return nil, err
+	}
+	if parent.ParentID != nil {
+		return nil, ErrNestedReply
+	}
+	return parent, nil
+}
+
+// replyRecipient works out who a reply is to. Replies to a direct message go to the other user in it,
+// and replies to everyone stay with everyone.
+func replyRecipient(parent *ChatRoomLog, msg types.UserMessageData) (uint, error) {
+	if parent.ToUserID == 0 {
+		if msg.ToUserID != 0 {
+			return 0, ErrReplyTarget
+		}
+		return 0, nil
+	}
+	if msg.FromUserID == parent.FromUserID {
+		return parent.ToUserID, nil
+	}
+	return parent.FromUserID, nil
+}
+
+// threadChanged recounts a thread's replies and tells whoever can see its parent message
+func (s *ChatRoomsService) threadChanged(room *ChatRoom, parentID uint) {
+	parent, err := s.ChatStorage.UpdateThreadSummary(parentID)
+	if err != nil {
+		s.log.Error(err.Error())
+		return
+	}
+	room.replaceChatLog(*parent)
+	room.NotifyMessageAudience(parent.FromUserID, parent.ToUserID, &types.Event{Event: "thread_updated", Data: types.ThreadSummaryData{
+		MessageID:   parent.ID,
+		ReplyCount:  parent.ReplyCount,
+		LastReplyAt: parent.LastReplyAt,
+	}})
+}
+
+// Thread pages through the replies to a message the visitor can see, oldest first
+func (s *ChatRoomsService) Thread(visitor *Visitor, messageID, after uint, limit int) (types.ThreadData, error) {
+	if limit < 0 || limit > maxChatPageSize {
+		return types.ThreadData{}, ErrPageSize
+	}
+	if limit == 0 {
+		limit = defaultChatPageSize
+	}
+
+	parent, err := s.threadParent(visitor, messageID)
+	if err != nil {
+		return types.ThreadData{}, err
+	}
+	replies, err := s.ChatStorage.GetRepliesPage(parent.ID, after, limit+1)
+	if err != nil {
+		return types.ThreadData{}, err
+	}
+
+	thread := types.ThreadData{Parent: parent.Data(), Replies: []types.UserMessageData{}, After: after}
+	if len(replies) > limit {
+		thread.HasMore = true
+		replies = replies[:limit]
+	}
+	for _, reply := range replies {
+		thread.Replies = append(thread.Replies, reply.Data())
+	}
+	if len(replies) > 0 {
+		thread.After = replies[len(replies)-1].ID
+	}
+	return thread, nil
+}
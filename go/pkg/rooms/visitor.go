@@ -1,8 +1,9 @@
 package rooms
 
 import (
+	"time"
+
 	"github.com/Embiggenerd/spiritio/pkg/users"
-	"github.com/Embiggenerd/spiritio/pkg/utils"
 	"github.com/Embiggenerd/spiritio/pkg/websocketClient"
 	"github.com/Embiggenerd/spiritio/types"
 	"github.com/pion/webrtc/v4"
@@ -19,24 +20,81 @@ func NewVisitor(client *websocketClient.WebsocketClient, user *users.User, room
 	return newVisitor
 }
 
+// Visitor is one websocket connection to a room. Saved, it is a session in the room's attendance.
 type Visitor struct {
 	gorm.Model
-	UserID         uint
+	UserID         uint      `gorm:"index"`
+	RoomID         uint      `gorm:"index"`
+	JoinedAt       time.Time `gorm:"index"`
+	LeftAt         *time.Time
+	PublishedMedia bool
+	ClientIP       string
 	Room           *ChatRoom                        `gorm:"-:all"`
 	User           *users.User                      `gorm:"foreignKey:UserID"`
-	Host           bool                             `gorm:"-:all"`
+	Presenter      bool                             `gorm:"-:all"`
+	HandRaised     bool                             `gorm:"-:all"`
+	Waiting        bool                             `gorm:"-:all"`
+	Invite         string                           `gorm:"-:all"`
 	Client         *websocketClient.WebsocketClient `gorm:"-:all"`
 	PeerConnection *webrtc.PeerConnection           `gorm:"-:all"`
 	StreamID       string                           `gorm:"-:all"`
 	SocketID       string                           `gorm:"-:all"`
 }
 
-func (v *Visitor) AddUser(user *users.User) {
-	v.User = user
+// AddUser signs the visitor in as user, unless user is banned from the room.
+// The invite they joined with, if any, is used up for user here.
+func (v *Visitor) AddUser(user *users.User) error {
+	if v.Room == nil {
+		v.User = user
+		return nil
+	}
+	var grantedRole Role
+	if user != nil && v.Room.Service != nil {
+		if err := v.Room.Service.CheckBan(v.Room.ID, user.ID); err != nil {
+			return err
+		}
+		if v.Invite != "" {
+			role, err := v.Room.Service.RedeemInvite(v.Room, v.Invite, user.ID)
+			if err != nil {
+				return err
+			}
+			grantedRole = role
+		}
+	}
+	v.Room.WithVisitor(v, func(v *Visitor) {
+		v.User = user
+	})
+	if user != nil && v.Room.Service != nil {
+		v.Room.Service.attendUser(v.Room, v)
+		v.Room.Service.claimRoom(v.Room, user.ID)
+		if grantedRole != "" {
+			v.Room.Service.grantRole(v.Room, user, grantedRole)
+		}
+		if v.InLobby() {
+			v.Room.Service.enterLobby(v.Room, user)
+		}
+	}
+	return nil
+}
+
+// SetName changes the visitor's display name
+func (v *Visitor) SetName(name string) {
+	v.Room.WithVisitor(v, func(v *Visitor) {
+		v.User.Name = name
+	})
+}
+
+// CanPublish reports whether a visitor may send media. In webinar mode only presenters, moderators and owners can.
+func (v *Visitor) CanPublish() bool {
+	canPublish := false
+	v.Room.WithVisitor(v, func(v *Visitor) {
+		canPublish = v.Presenter || v.Room.canPublish(v.User)
+	})
+	return canPublish
 }
 
 func (v *Visitor) CreateUniqueDisplayName() {
-	v.User.Name = v.Room.untilUnique(utils.RandName())
+	v.SetName(v.Room.CreateUniqueDisplayName())
 }
 
 func (v *Visitor) Clarify(ask string) error {
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/rooms"
+)
+
+// serveAttendance lists a room's visitor sessions as JSON or CSV. The from and to query params
+// (RFC 3339) limit it to sessions that overlap that window, and user_id to one user.
+func (s *APIServer) serveAttendance(w http.ResponseWriter, r *http.Request, roomSlug string, asCSV bool) {
+	ctx := r.Context()
+	room, _, ok := s.authorizeRequest(w, r, roomSlug, rooms.PermAttendance)
+	if !ok {
+		return
+	}
+
+	query, err := attendanceQuery(r)
+	if err != nil {
+		s.handleHTTPError(ctx, w, err.Error(), http.StatusBadRequest, err)
+		return
+	}
+	attendance, err := s.roomsService.Attendance(room, query)
+	if err != nil {
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return
+	}
+
+	if !asCSV {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(attendance); err != nil {
+			s.log.Error(err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+room.Metadata().Slug+`-attendance.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "user_id", "user_name", "joined_at", "left_at", "duration_seconds", "published_media", "client_ip"})
+	for _, session := range attendance {
+		leftAt := ""
+		if session.LeftAt != nil {
+			leftAt = session.LeftAt.UTC().Format(time.RFC3339)
+		}
+		out.Write([]string{
+			strconv.FormatUint(uint64(session.ID), 10),
+			strconv.FormatUint(uint64(session.UserID), 10),
+			csvCell(session.UserName),
+			session.JoinedAt.UTC().Format(time.RFC3339),
+			leftAt,
+			strconv.FormatInt(session.DurationSeconds, 10),
+			strconv.FormatBool(session.PublishedMedia),
+			csvCell(session.ClientIP),
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		s.log.Error(err.Error())
+	}
+}
+
+func attendanceQuery(r *http.Request) (rooms.AttendanceQuery, error) {
+	params := r.URL.Query()
+	query := rooms.AttendanceQuery{}
+	var err error
+	if from := params.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, errors.New("from must be an RFC 3339 time")
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, errors.New("to must be an RFC 3339 time")
+		}
+	}
+	if userID := params.Get("user_id"); userID != "" {
+		id, err := strconv.ParseUint(userID, 10, 64)
+		if err != nil {
+			return query, errors.New("user_id must be a number")
+		}
+		query.UserID = uint(id)
+	}
+	return query, nil
+}
+
+// csvCell keeps spreadsheets from running a cell as a formula, since names are chosen by visitors
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// clientIP is the address a request came from, without its port. Requests relayed by a trusted
+// reverse proxy came from the last address in X-Forwarded-For that isn't one of our proxies.
+func (s *APIServer) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !s.trustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if !s.trustedProxy(hop) {
+			return hop
+		}
+	}
+	// Proxies that don't set X-Forwarded-For usually set X-Real-IP
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+// trustedProxy reports whether an address is one of the reverse proxies listed in config, by address or CIDR range
+func (s *APIServer) trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, trusted := range strings.Split(s.cfg.TrustedProxies, ",") {
+		trusted = strings.TrimSpace(trusted)
+		if _, network, err := net.ParseCIDR(trusted); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if trustedIP := net.ParseIP(trusted); trustedIP != nil && trustedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Embiggenerd/spiritio/pkg/config"
+)
+
+func TestCSVCell(t *testing.T) {
+	cells := map[string]string{
+		"alice":             "alice",
+		"=HYPERLINK(\"x\")": "'=HYPERLINK(\"x\")",
+		"+1":                "'+1",
+		"-1":                "'-1",
+		"@SUM(A1)":          "'@SUM(A1)",
+		"":                  "",
+	}
+	for value, want := range cells {
+		if got := csvCell(value); got != want {
+			t.Errorf("csvCell(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.TrustedProxies = "127.0.0.1,10.0.0.0/8"
+	s := &APIServer{cfg: cfg}
+
+	requests := []struct {
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"203.0.113.7:1234", "", "", "203.0.113.7"},
+		// Only proxies get to say who they are relaying for
+		{"203.0.113.7:1234", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"127.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		// Clients can put anything in the header before it reaches the proxy
+		{"127.0.0.1:1234", "192.0.2.9, 198.51.100.1", "", "198.51.100.1"},
+		{"127.0.0.1:1234", "198.51.100.1, 10.1.2.3", "", "198.51.100.1"},
+		{"127.0.0.1:1234", "", "198.51.100.2", "198.51.100.2"},
+		{"127.0.0.1:1234", "", "", "127.0.0.1"},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = req.remoteAddr
+		if req.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", req.forwarded)
+		}
+		if req.realIP != "" {
+			r.Header.Set("X-Real-IP", req.realIP)
+		}
+		if got := s.clientIP(r); got != req.want {
+			t.Errorf("clientIP from %s forwarded for %q = %s, want %s", req.remoteAddr, req.forwarded, got, req.want)
+		}
+	}
+}
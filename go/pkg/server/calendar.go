@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/rooms"
+)
+
+const (
+	icsTimeFormat = "20060102T150405Z"
+	// calendarInviteExpiry is how long the invite in a calendar file lasts when the schedule never ends
+	calendarInviteExpiry = 90 * 24 * time.Hour
+)
+
+// serveRoomCalendar serves an iCalendar file for a room's schedule with an invite link in it.
+// Only those who may invite people can download it.
+func (s *APIServer) serveRoomCalendar(w http.ResponseWriter, r *http.Request, roomSlug string) {
+	ctx := r.Context()
+	room, user, ok := s.authorizeRequest(w, r, roomSlug, rooms.PermInvite)
+	if !ok {
+		return
+	}
+
+	metadata := room.Metadata()
+	if !metadata.Schedule.Scheduled() {
+		s.handleHTTPError(ctx, w, "room has no schedule", http.StatusNotFound, nil)
+		return
+	}
+	expiresIn := calendarInviteExpiry
+	if lastEnd, ok := metadata.Schedule.LastEnd(); ok {
+		expiresIn = time.Until(lastEnd)
+	}
+	if expiresIn <= 0 {
+		s.handleHTTPError(ctx, w, "the meeting is over", http.StatusGone, nil)
+		return
+	}
+
+	invitees, err := s.roomsService.Invitees(room)
+	if err != nil {
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return
+	}
+	token, err := s.roomsService.CalendarInvite(room, user.ID, expiresIn)
+	if err != nil {
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	link := scheme + "://" + r.Host + invitePath(metadata.Slug, token)
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", metadata.Slug+".ics"))
+	w.Write([]byte(calendar(room.ID, metadata, invitees, link, r.Host)))
+}
+
+// invitePath is where an invite token lets someone into a room
+func invitePath(roomSlug, token string) string {
+	return "/?room=" + url.QueryEscape(roomSlug) + "&invite=" + url.QueryEscape(token)
+}
+
+// calendar renders a room's schedule as an iCalendar file with a single event
+func calendar(roomID uint, metadata rooms.RoomMetadata, invitees []string, link, host string) string {
+	schedule := metadata.Schedule
+	summary := metadata.Name
+	if summary == "" {
+		summary = metadata.Slug
+	}
+	description := "Join: " + link
+	if metadata.Topic != "" {
+		description = metadata.Topic + "\n\n" + description
+	}
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//spiritio//rooms//EN",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:room-%d@%s", roomID, host),
+		"DTSTAMP:" + time.Now().UTC().Format(icsTimeFormat),
+		"DTSTART:" + schedule.StartsAt.UTC().Format(icsTimeFormat),
+	}
+	if schedule.EndsAt != nil {
+		lines = append(lines, "DTEND:"+schedule.EndsAt.UTC().Format(icsTimeFormat))
+	}
+	if schedule.Recurrence != "" {
+		lines = append(lines, "RRULE:"+schedule.Recurrence)
+	}
+	lines = append(lines,
+		"SUMMARY:"+escapeICS(summary),
+		"DESCRIPTION:"+escapeICS(description),
+		"LOCATION:"+escapeICS(link),
+		"URL:"+link,
+	)
+	for _, invitee := range invitees {
+		lines = append(lines, "ATTENDEE;ROLE=REQ-PARTICIPANT:mailto:"+invitee)
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	var ics strings.Builder
+	for _, line := range lines {
+		ics.WriteString(foldICS(line))
+		ics.WriteString("\r\n")
+	}
+	return ics.String()
+}
+
+// escapeICS escapes the characters iCalendar text values treat specially
+func escapeICS(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// foldICS splits a content line into 75 octet pieces without breaking up UTF-8 characters
+func foldICS(line string) string {
+	var folded strings.Builder
+	width := 0
+	for _, char := range line {
+		size := len(string(char))
+		if width+size > 75 {
+			folded.WriteString("\r\n ")
+			width = 1
+		}
+		folded.WriteRune(char)
+		width += size
+	}
+	return folded.String()
+}
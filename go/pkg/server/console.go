@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+// RunConsole reads admin commands from r, one per line, until it is exhausted.
+//
+//	play <room> <video.ivf|-> <audio.ogg|-> [loop]
+//	stop <room> <streamID>
+func (s *APIServer) RunConsole(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			s.log.Error("usage: play <room> <video|-> <audio|-> [loop] | stop <room> <streamID>")
+			continue
+		}
+
+		room, err := s.roomsService.GetRoomBySlug(fields[1])
+		if err != nil {
+			s.log.Error(err.Error())
+			continue
+		}
+
+		switch fields[0] {
+		case "play":
+			if len(fields) < 4 {
+				s.log.Error("usage: play <room> <video|-> <audio|-> [loop]")
+				continue
+			}
+			details := types.PublishFileWorkOrderDetail{
+				Video: consoleArg(fields[2]),
+				Audio: consoleArg(fields[3]),
+				Loop:  len(fields) > 4 && fields[4] == "loop",
+			}
+			publisher, err := s.publishFiles(room, details)
+			if err != nil {
+				s.log.Error(err.Error())
+				continue
+			}
+			room.BroadcastEvent(&types.Event{Event: "file_publishing", Data: types.FilePublisherData{
+				StreamID: publisher.StreamID,
+				Video:    details.Video,
+				Audio:    details.Audio,
+			}})
+			s.log.Info("publishing " + publisher.StreamID + " in room " + fields[1])
+
+		case "stop":
+			if err := room.SFU.StopPublisher(fields[2]); err != nil {
+				s.log.Error(err.Error())
+				continue
+			}
+			room.BroadcastEvent(&types.Event{Event: "file_stopped", Data: types.FilePublisherData{StreamID: fields[2]}})
+			s.log.Info("stopped " + fields[2] + " in room " + fields[1])
+
+		default:
+			s.log.Error("unknown command: " + fields[0])
+		}
+	}
+}
+
+// consoleArg treats "-" as an omitted argument
+func consoleArg(arg string) string {
+	if arg == "-" {
+		return ""
+	}
+	return arg
+}
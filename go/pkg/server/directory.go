@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Embiggenerd/spiritio/pkg/rooms"
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/types"
+)
+
+// directoryChannel is the channel visitors subscribe to for live directory updates
+const directoryChannel = "room_directory"
+
+// roomDirectory tracks who is watching the public room directory, and which rooms they were told are listed
+type roomDirectory struct {
+	mu          sync.Mutex
+	subscribers map[*rooms.Visitor]bool
+	// listed maps the id of every room subscribers see to the slug they know it by
+	listed map[uint]string
+}
+
+func (d *roomDirectory) subscribe(visitor *rooms.Visitor) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.subscribers == nil {
+		d.subscribers = map[*rooms.Visitor]bool{}
+	}
+	d.subscribers[visitor] = true
+}
+
+func (d *roomDirectory) unsubscribe(visitor *rooms.Visitor) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.subscribers, visitor)
+}
+
+// update records whether a room is listed, returning the events that tell subscribers about the change
+// along with the subscribers to send them to. Rooms that stop being public, or change slug, are removed
+// under their old slug. entry is only used for public rooms.
+func (d *roomDirectory) update(roomID uint, metadata rooms.RoomMetadata, entry types.DirectoryRoomData) ([]*types.Event, []*rooms.Visitor) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listed == nil {
+		d.listed = map[uint]string{}
+	}
+
+	events := []*types.Event{}
+	if slug, ok := d.listed[roomID]; ok && (!metadata.Settings.Public || slug != metadata.Slug) {
+		events = append(events, &types.Event{Event: "room_directory_removed", Data: slug})
+		delete(d.listed, roomID)
+	}
+	if metadata.Settings.Public {
+		events = append(events, &types.Event{Event: "room_directory_updated", Data: entry})
+		d.listed[roomID] = metadata.Slug
+	}
+
+	subscribers := make([]*rooms.Visitor, 0, len(d.subscribers))
+	for subscriber := range d.subscribers {
+		subscribers = append(subscribers, subscriber)
+	}
+	return events, subscribers
+}
+
+// publishDirectoryEntry tells directory subscribers about a room's occupancy. The room is asked about
+// itself and subscribers are written to outside the directory's lock, so that one busy room or slow
+// socket doesn't hold up updates for every other room.
+func (s *APIServer) publishDirectoryEntry(room *rooms.ChatRoom) {
+	metadata := room.Metadata()
+	var entry types.DirectoryRoomData
+	if metadata.Settings.Public {
+		entry = s.roomsService.DirectoryEntry(room)
+	}
+
+	events, subscribers := s.directory.update(room.ID, metadata, entry)
+	for _, subscriber := range subscribers {
+		for _, event := range events {
+			subscriber.Notify(event)
+		}
+	}
+}
+
+// serveRoomDirectory lists public rooms, optionally filtered by the q query param
+func (s *APIServer) serveRoomDirectory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries, err := s.roomsService.Directory(r.URL.Query().Get("q"))
+	if err != nil {
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		s.log.Error(err.Error())
+	}
+}
+
+// serveRoomAPI routes /api/rooms/<room>/<resource> to the handler for the resource
+func (s *APIServer) serveRoomAPI(w http.ResponseWriter, r *http.Request) {
+	roomSlug, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch resource {
+	case "calendar.ics":
+		s.serveRoomCalendar(w, r, roomSlug)
+	case "attendance", "attendance.csv":
+		s.serveAttendance(w, r, roomSlug, resource == "attendance.csv")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorizeRequest finds the room a REST request is about and checks that the user signed in with
+// the request's access token holds a permission there. It writes the error response when they don't.
+func (s *APIServer) authorizeRequest(w http.ResponseWriter, r *http.Request, roomSlug string, permission rooms.Permission) (*rooms.ChatRoom, *users.User, bool) {
+	ctx := r.Context()
+	user, err := s.requestUser(r)
+	if err != nil {
+		s.handleHTTPError(ctx, w, "unauthorized", http.StatusUnauthorized, err)
+		return nil, nil, false
+	}
+	room, err := s.roomsService.GetRoomBySlug(roomSlug)
+	if errors.Is(err, rooms.ErrRoomNotFound) {
+		s.handleHTTPError(ctx, w, err.Error(), http.StatusNotFound, err)
+		return nil, nil, false
+	}
+	if err != nil {
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+	if !room.Allows(user, permission) {
+		s.handleHTTPError(ctx, w, permissionDenied(permission), http.StatusForbidden, nil)
+		return nil, nil, false
+	}
+	return room, user, true
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/rooms"
+)
+
+// serveMessageSearch searches the messages the signed in user can read for the words in the q query param.
+// author_id, room (a slug), from and to (RFC 3339) narrow it down, and limit and offset page through it.
+func (s *APIServer) serveMessageSearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := s.requestUser(r)
+	if err != nil {
+		s.handleHTTPError(ctx, w, "unauthorized", http.StatusUnauthorized, err)
+		return
+	}
+
+	query, err := searchQuery(r)
+	if err != nil {
+		s.handleHTTPError(ctx, w, err.Error(), http.StatusBadRequest, err)
+		return
+	}
+	found, err := s.roomsService.SearchMessages(user, query)
+	if err != nil {
+		s.handleHTTPError(ctx, w, searchErrorMessage(err), searchErrorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(found); err != nil {
+		s.log.Error(err.Error())
+	}
+}
+
+func searchQuery(r *http.Request) (rooms.SearchQuery, error) {
+	params := r.URL.Query()
+	query := rooms.SearchQuery{Text: params.Get("q"), RoomSlug: params.Get("room")}
+	var err error
+	if from := params.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, errors.New("from must be an RFC 3339 time")
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, errors.New("to must be an RFC 3339 time")
+		}
+	}
+	if authorID := params.Get("author_id"); authorID != "" {
+		id, err := strconv.ParseUint(authorID, 10, 64)
+		if err != nil {
+			return query, errors.New("author_id must be a number")
+		}
+		query.AuthorID = uint(id)
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return query, errors.New("limit must be a number")
+		}
+	}
+	if offset := params.Get("offset"); offset != "" {
+		if query.Offset, err = strconv.Atoi(offset); err != nil {
+			return query, errors.New("offset must be a number")
+		}
+	}
+	return query, nil
+}
+
+func searchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, rooms.ErrEmptySearch), errors.Is(err, rooms.ErrSearchPage):
+		return http.StatusBadRequest
+	case errors.Is(err, rooms.ErrSearchUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// searchErrorMessage keeps database errors from reaching clients
+func searchErrorMessage(err error) string {
+	if searchErrorStatus(err) == http.StatusInternalServerError {
+		return "internal server error"
+	}
+	return err.Error()
+}
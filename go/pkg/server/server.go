@@ -3,16 +3,20 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	"github.com/Embiggenerd/spiritio/pkg/config"
 	"github.com/Embiggenerd/spiritio/pkg/logger"
 	"github.com/Embiggenerd/spiritio/pkg/rooms"
+	"github.com/Embiggenerd/spiritio/pkg/sfu"
 	"github.com/Embiggenerd/spiritio/pkg/users"
 	"github.com/Embiggenerd/spiritio/pkg/utils"
 	"github.com/Embiggenerd/spiritio/pkg/websocketClient"
@@ -21,11 +25,23 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+var errPublisherLimit = errors.New("room has reached its publisher limit")
+
+// lobbyOrders are the work orders a visitor waiting in the lobby may send, which let them sign in
+var lobbyOrders = map[string]bool{
+	"validate_access_token":       true,
+	"validate_user_name_password": true,
+}
+
 type APIServer struct {
+	cfg          *config.Config
 	server       *http.Server
 	roomsService rooms.RoomsService
 	userService  users.Users
 	log          logger.Logger
+	whipSessions httpSessions
+	whepSessions httpSessions
+	directory    roomDirectory
 }
 
 func NewServer(ctx context.Context, cfg *config.Config, log logger.Logger, roomsService rooms.RoomsService, usersService users.Users) *APIServer {
@@ -35,12 +51,16 @@ func NewServer(ctx context.Context, cfg *config.Config, log logger.Logger, rooms
 	}
 
 	log.Info("api server up")
-	return &APIServer{
+	s := &APIServer{
+		cfg:          cfg,
 		server:       server,
 		roomsService: roomsService,
 		userService:  usersService,
 		log:          log,
 	}
+	roomsService.OnOccupancyChanged(s.publishDirectoryEntry)
+	roomsService.OnRoomClosed(s.publishDirectoryEntry)
+	return s
 }
 
 func (s *APIServer) Run() {
@@ -49,6 +69,11 @@ func (s *APIServer) Run() {
 	mux.Handle("/", fs)
 
 	mux.HandleFunc("/ws", s.serveWS)
+	mux.HandleFunc("/whip/", s.serveWHIP)
+	mux.HandleFunc("/whep/", s.serveWHEP)
+	mux.HandleFunc("/api/rooms", s.serveRoomDirectory)
+	mux.HandleFunc("/api/rooms/", s.serveRoomAPI)
+	mux.HandleFunc("/api/search", s.serveMessageSearch)
 
 	withMW := s.log.LoggingMW(mux)
 
@@ -72,37 +97,58 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 		s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, nil)
 		return
 	}
-	defer wsClient.Conn.Close()
+	defer wsClient.Close()
 
 	var room *rooms.ChatRoom
-	roomIDStr := r.URL.Query().Get("room")
+	roomSlug := r.URL.Query().Get("room")
 
 	// visitor will be used throughout to gain access to user info and write to connection
 	visitor := rooms.NewVisitor(wsClient, nil, room)
+	visitor.ClientIP = s.clientIP(r)
+	defer s.directory.unsubscribe(visitor)
+
+	// leave runs once, whether the socket sent a close message or just dropped
+	var leaveOnce sync.Once
+	leave := func() {
+		leaveOnce.Do(func() {
+			if visitor.Room == nil || !visitor.Room.RemoveVisitor(visitor) {
+				return
+			}
+
+			if visitor.User != nil {
+				event := &types.Event{Event: "user_exited_chat", Data: types.UserExitedChatData{
+					Name: visitor.User.Name, ID: visitor.User.ID,
+				}}
+				visitor.Room.BroadcastEvent(event)
+			}
+		})
+	}
 
 	closeHandler := wsClient.Conn.CloseHandler()
 	wsClient.Conn.SetCloseHandler(func(code int, text string) error {
-
 		// Remove visitor from room on websocket close message
-		for i, v := range room.Visitors {
-			if visitor.SocketID == v.SocketID {
-				room.Visitors = append(room.Visitors[:i], room.Visitors[i+1:]...)
-				break
-			}
-		}
-
-		if visitor.User != nil {
-			event := &types.Event{Event: "user_exited_chat", Data: types.UserExitedChatData{
-				Name: visitor.User.Name, ID: visitor.User.ID,
-			}}
-			visitor.Room.BroadcastEvent(event)
-		}
+		leave()
 		return closeHandler(code, text)
 	})
 
-	if roomIDStr == "" {
-		// If the user does not have roomID in search params, create new room
-		room, err = s.roomsService.CreateRoom(ctx)
+	if roomSlug == "" {
+		// If the user does not have a room in search params, create new room.
+		// Whoever asked for it can claim it, so first-time visitors get an account here.
+		creator, err := s.requestUser(r)
+		if err != nil {
+			var accessToken string
+			creator, accessToken, err = s.userService.CreateUser(false)
+			if err != nil {
+				s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, nil)
+				return
+			}
+			visitor.Notify(&types.Event{Event: "user_logged_in", Data: types.UserLoggedInData{
+				Name:        creator.Name,
+				ID:          creator.ID,
+				AccessToken: accessToken,
+			}})
+		}
+		room, err = s.roomsService.CreateRoom(ctx, creator.ID)
 		if err != nil {
 			s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, nil)
 			return
@@ -110,69 +156,65 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 		// Create and send message with appropriate event
 		event := &types.Event{}
 		event.Event = "created_room"
-		event.Data = strconv.FormatUint(uint64(room.ID), 10)
+		event.Data = room.Metadata().Slug
 		visitor.Notify(event)
 		return
 	}
 	// If there is a room specified, they will be redirected here
-	roomID, err := utils.StringToUint(roomIDStr)
-	if err != nil {
-		// If the room ID can't be parsed, create a new room
-		room, err = s.roomsService.CreateRoom(ctx)
-		if err != nil {
-			s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, nil)
-			return
-		}
-		// Create and send message with appropriate event
-		event := &types.Event{}
-		event.Event = "created_room"
-		event.Data = strconv.FormatUint(uint64(room.ID), 10)
-		visitor.Notify(event)
+	room, err = s.roomsService.GetRoomBySlug(roomSlug)
+	if errors.Is(err, rooms.ErrRoomNotFound) {
+		s.handleError(ctx, err.Error(), http.StatusNotFound, err, visitor)
 		return
-
 	}
-	room, err = s.roomsService.GetRoomByID(roomID)
 	if err != nil {
-		// If room ID can't be found, create a new room
-		room, err = s.roomsService.CreateRoom(ctx)
-		if err != nil {
-			s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, nil)
+		s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+		return
+	}
+
+	// Visitors sign in once they have joined, but hosts who sent their token can get past a locked or full room
+	joiner, _ := s.requestUser(r)
+	if joiner != nil {
+		if err := s.roomsService.CheckBan(room.ID, joiner.ID); err != nil {
+			s.handleError(ctx, err.Error(), http.StatusForbidden, err, visitor)
 			return
 		}
-		// Create and send message with appropriate event
-		event := &types.Event{}
-		event.Event = "created_room"
-		event.Data = strconv.FormatUint(uint64(room.ID), 10)
-		wsClient.Writer.WriteJSON(event)
+	}
+
+	// The invite is used once the visitor signs in, so reconnecting doesn't use it up
+	visitor.Invite, err = s.checkRoomAccess(r, room, joiner)
+	if err != nil {
+		s.handleError(ctx, err.Error(), http.StatusForbidden, err, visitor)
 		return
 	}
 
 	visitor.Room = room
-	room.AddVisitor(visitor)
-
-	event := &types.Event{}
-	event.Event = "joined_room"
-	// create chat events from room's chatlog cache
-	var chats []types.UserMessageData
-	for i := 0; i < len(room.ChatLog); i++ {
-		chat := room.ChatLog[i].UserMessageData
-		chats = append(chats, chat)
-	}
-
-	visitors := []types.Visitor{}
-	for _, v := range room.Visitors {
-		utils.PrintStruct(v)
-		if v.User != nil {
-			visitors = append(visitors, types.Visitor{ID: v.User.ID, Name: v.User.Name})
+	err = room.AddVisitor(visitor, joiner)
+	if errors.Is(err, rooms.ErrRoomClosed) {
+		// The room was evicted while we were joining, so load it again
+		room, err = s.roomsService.GetRoomByID(room.ID)
+		if err == nil {
+			visitor.Room = room
+			err = room.AddVisitor(visitor, joiner)
 		}
 	}
-
-	event.Data = types.JoinedRoomData{
-		ChatLog:  chats,
-		RoomID:   room.ID,
-		Visitors: visitors,
+	if errors.Is(err, rooms.ErrRoomLocked) || errors.Is(err, rooms.ErrRoomFull) {
+		s.handleError(ctx, err.Error(), http.StatusForbidden, err, visitor)
+		return
 	}
-	visitor.Notify(event)
+	if err != nil {
+		s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+		return
+	}
+	defer leave()
+
+	if startsAt, held := room.NotStarted(); held && visitor.InLobby() {
+		// Early arrivals wait for the meeting to start, unless they turn out to be a host
+		visitor.Notify(&types.Event{Event: "meeting_not_started", Data: types.MeetingData{RoomID: room.ID, StartsAt: startsAt}})
+	} else if visitor.InLobby() {
+		// The chat log and media stay hidden until a host lets them in
+		visitor.Notify(&types.Event{Event: "lobby_waiting", Data: room.ID})
+	}
+	// Everyone else is sent joined_room once they have signed in
 
 	// ask for authentication
 	visitor.Clarify("access_token")
@@ -190,15 +232,36 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 		}
 		s.log.LogWorkOrderReceived(ctx, workOrder)
 
+		// Until they sign in, and we know they are not banned, visitors can do nothing else
+		if workOrder.Order != "validate_access_token" && visitor.User == nil {
+			s.handleError(ctx, "please log in first", http.StatusUnauthorized, nil, visitor)
+			continue
+		}
+		if !lobbyOrders[workOrder.Order] && visitor.InLobby() {
+			s.handleError(ctx, "please wait to be admitted", http.StatusForbidden, nil, visitor)
+			continue
+		}
+
 		switch workOrder.Order {
 		case "media_request":
-			peerConnection, err = room.SFU.CreatePeerConnection()
+			// Only publishers count toward the limit, everyone can watch
+			if visitor.CanPublish() {
+				if err := s.admitPublisher(room); err != nil {
+					s.handleError(ctx, err.Error(), http.StatusServiceUnavailable, err, visitor)
+					break
+				}
+			}
+
+			peerConnection, err = room.SFU.CreatePeerConnection(visitor.CanPublish())
 			if err != nil {
 				s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
 				return
 			}
 			defer peerConnection.Close()
 
+			room.WithVisitor(visitor, func(v *rooms.Visitor) {
+				v.PeerConnection = peerConnection
+			})
 			room.AddPeerConnection(peerConnection, wsClient.Writer)
 
 			peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
@@ -233,24 +296,22 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 			})
 
 			peerConnection.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
-				// Create a track to fan out our incoming video to all peers
-				trackLocal := room.SFU.AddTrack(t)
-				visitor.StreamID = trackLocal.StreamID()
-				defer room.SFU.RemoveTrack(trackLocal)
-
-				buf := make([]byte, 1500)
-				for {
-					i, _, err := t.Read(buf)
-					if err != nil {
-						s.log.Error(err.Error())
-						return
-					}
+				// Audience members can only subscribe, even if their browser sends media anyway
+				if !visitor.CanPublish() {
+					return
+				}
 
-					if _, err = trackLocal.Write(buf[:i]); err != nil {
-						s.log.Error(err.Error())
-						return
-					}
+				if t.Kind() == webrtc.RTPCodecTypeVideo && !room.Metadata().Settings.VideoEnabled {
+					return
 				}
+
+				// Create a track to fan out our incoming video to all peers
+				trackLocal := room.SFU.AddTrack(t)
+				room.WithVisitor(visitor, func(v *rooms.Visitor) {
+					v.StreamID = trackLocal.StreamID()
+					v.PublishedMedia = true
+				})
+				s.forwardTrack(room, t, trackLocal)
 			})
 
 			room.SFU.SignalPeerConnections()
@@ -258,87 +319,44 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 		case "validate_access_token":
 			token, err := s.userService.ValidateAccessToken(workOrder.Details.(string))
 			if err != nil {
-				user, accessToken, err := s.userService.CreateUser(false)
-				if err != nil {
-					s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
-					break
-				}
-				visitor.AddUser(user)
-
-				data := types.UserLoggedInData{
-					Name:        user.Name,
-					ID:          user.ID,
-					AccessToken: accessToken,
-				}
-
-				event := &types.Event{
-					Event: "user_logged_in",
-					Data:  data,
+				if !s.signInNewUser(ctx, visitor) {
+					return
 				}
+				break
+			}
 
-				visitor.Notify(event)
-				visitor.Clarify("credentials")
-
-				event = &types.Event{
-					Event: "user_entered_chat",
-					Data:  user.Name,
+			user, err := s.userService.GetUserFromAccessToken(token)
+			if err != nil {
+				s.handleError(ctx, "failed parsing user token", http.StatusInternalServerError, err, visitor)
+				if !s.signInNewUser(ctx, visitor) {
+					return
 				}
-				visitor.Room.BroadcastEvent(event)
-
-			} else {
-				user, err := s.userService.GetUserFromAccessToken(token)
-				if err != nil {
-					s.handleError(ctx, "failed parsing user token", http.StatusInternalServerError, err, visitor)
-					// below code is untested and seems to be broken
-					user, accessToken, err := s.userService.CreateUser(false)
-
-					event := &types.Event{
-						Event: "user_entered_chat",
-						Data:  user.Name,
-					}
-					visitor.Room.BroadcastEvent(event)
-
-					visitor.AddUser(user)
-					if err != nil {
-						s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
-						return
-					}
-
-					data := types.UserLoggedInData{
-						Name:        user.Name,
-						ID:          user.ID,
-						AccessToken: accessToken,
-					}
-
-					event = &types.Event{
-						Event: "user_logged_in",
-						Data:  data,
-					}
+				break
+			}
 
-					visitor.Notify(event)
-					visitor.Clarify("credentials")
-				}
+			if !s.signIn(ctx, visitor, user) {
+				return
+			}
 
-				event := &types.Event{
-					Event: "user_entered_chat",
-					Data:  user.Name,
-				}
+			event := &types.Event{
+				Event: "user_entered_chat",
+				Data:  user.Name,
+			}
+			// Visitors waiting in the lobby are announced once they are admitted
+			if !visitor.InLobby() {
 				visitor.Room.BroadcastEvent(event)
+			}
 
-				visitor.User = user
-
-				data := types.UserLoggedInData{
-					Name:        user.Name,
-					ID:          user.ID,
-					AccessToken: workOrder.Details.(string),
-				}
-				event = &types.Event{
-					Event: "user_logged_in",
-					Data:  data,
-				}
-				visitor.Notify(event)
-
+			data := types.UserLoggedInData{
+				Name:        user.Name,
+				ID:          user.ID,
+				AccessToken: workOrder.Details.(string),
+			}
+			event = &types.Event{
+				Event: "user_logged_in",
+				Data:  data,
 			}
+			visitor.Notify(event)
 
 		case "candidate":
 			candidate := webrtc.ICECandidateInit{}
@@ -358,11 +376,25 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
+			if err := room.SFU.ValidateCodecs(answer); err != nil {
+				// Publishers that can't encode any of the room's codecs are turned away
+				s.handleError(ctx, err.Error(), http.StatusNotAcceptable, err, visitor)
+				if err := peerConnection.Close(); err != nil {
+					s.log.Error(err.Error())
+				}
+				break
+			}
+
 			if err := peerConnection.SetRemoteDescription(answer); err != nil {
 				s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
 			}
 
 		case "user_message":
+			if !room.Metadata().Settings.ChatEnabled {
+				s.handleError(ctx, "chat is turned off in this room", http.StatusForbidden, nil, visitor)
+				break
+			}
+
 			wo := &types.UserMessageWorkOrder{}
 			err = json.Unmarshal(raw, wo)
 			if err != nil {
@@ -371,11 +403,24 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 			}
 
 			data := types.UserMessageData{
-				Text:         wo.Details.Text,
-				ToUserID:     wo.Details.ToUserID,
-				FromUserName: visitor.User.Name,
-				UserVerified: visitor.User.Verified != 0,
-				FromUserID:   visitor.User.ID,
+				Text:            wo.Details.Text,
+				ToUserID:        wo.Details.ToUserID,
+				ClientMessageID: wo.Details.ClientMessageID,
+				ParentID:        wo.Details.ParentID,
+				FromUserName:    visitor.User.Name,
+				UserVerified:    visitor.User.Verified != 0,
+				FromUserID:      visitor.User.ID,
+			}
+
+			// Write new chatlog to DB with this room's ID as foreign key, so the event carries its id
+			data, duplicate, err := s.roomsService.SaveChatLog(data, visitor)
+			if errors.Is(err, rooms.ErrMessageNotFound) || errors.Is(err, rooms.ErrNestedReply) || errors.Is(err, rooms.ErrReplyTarget) {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			if err != nil {
+				s.handleError(ctx, "user message did not go through", http.StatusBadRequest, err, visitor)
+				break
 			}
 
 			event := &types.Event{
@@ -383,15 +428,15 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 				Data:  data,
 			}
 
+			// A retry only needs to reach the sender, everyone else already has the message
+			if duplicate {
+				visitor.Notify(event)
+				break
+			}
+
 			isDirectMessage := data.ToUserID != 0
 			if isDirectMessage {
-				userPresent := false
-				for _, v := range visitor.Room.Visitors {
-					if v.User.ID == data.ToUserID {
-						userPresent = true
-						v.Notify(event)
-					}
-				}
+				userPresent := room.NotifyUser(data.ToUserID, event)
 				if !userPresent {
 					s.handleError(ctx, "user is not present", 400, nil, visitor)
 				}
@@ -399,12 +444,140 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 				room.BroadcastEvent(event)
 			}
 
-			// Write new chatlog to DB with this room's ID as foreign key
-			err := s.roomsService.SaveChatLog(data, visitor)
+		case "edit_message":
+			if visitor.User == nil {
+				s.handleError(ctx, "please log in first", http.StatusUnauthorized, nil, visitor)
+				break
+			}
+			if !room.Metadata().Settings.ChatEnabled {
+				s.handleError(ctx, "chat is turned off in this room", http.StatusForbidden, nil, visitor)
+				break
+			}
+
+			wo := &types.EditMessageWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "edit details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			message, err := s.roomsService.EditMessage(visitor, wo.Details.ID, wo.Details.Text)
 			if err != nil {
-				s.log.Error(err.Error())
+				s.handleMessageError(ctx, err, visitor)
+				break
+			}
+			room.NotifyMessageChanged("message_edited", message)
+
+		case "delete_message":
+			if visitor.User == nil {
+				s.handleError(ctx, "please log in first", http.StatusUnauthorized, nil, visitor)
+				break
+			}
+			wo := &types.DeleteMessageWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "delete details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			message, err := s.roomsService.DeleteMessage(visitor, wo.Details.ID)
+			if err != nil {
+				s.handleMessageError(ctx, err, visitor)
+				break
+			}
+			room.NotifyMessageChanged("message_deleted", message)
+
+		case "add_reaction", "remove_reaction":
+			if visitor.User == nil {
+				s.handleError(ctx, "please log in first", http.StatusUnauthorized, nil, visitor)
+				break
+			}
+			if !room.Metadata().Settings.ChatEnabled {
+				s.handleError(ctx, "chat is turned off in this room", http.StatusForbidden, nil, visitor)
+				break
+			}
+
+			wo := &types.ReactionWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "reaction details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			react := s.roomsService.AddReaction
+			if workOrder.Order == "remove_reaction" {
+				react = s.roomsService.RemoveReaction
+			}
+			message, err := react(visitor, wo.Details.MessageID, wo.Details.Emoji)
+			if err != nil {
+				s.handleMessageError(ctx, err, visitor)
+				break
+			}
+			reactions := types.ReactionsData{MessageID: message.ID, Reactions: message.Reactions}
+			room.NotifyMessageAudience(message.FromUserID, message.ToUserID, &types.Event{Event: "reaction_updated", Data: reactions})
+
+		case "get_thread":
+			if visitor.User == nil {
+				s.handleError(ctx, "please log in first", http.StatusUnauthorized, nil, visitor)
+				break
+			}
+
+			wo := &types.GetThreadWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "thread details are not valid", http.StatusBadRequest, err, visitor)
+				break
 			}
 
+			thread, err := s.roomsService.Thread(visitor, wo.Details.MessageID, wo.Details.After, wo.Details.Limit)
+			if err != nil {
+				s.handleMessageError(ctx, err, visitor)
+				break
+			}
+			visitor.Notify(&types.Event{Event: "thread", Data: thread})
+
+		case "search_messages":
+			if visitor.User == nil {
+				s.handleError(ctx, "please log in first", http.StatusUnauthorized, nil, visitor)
+				break
+			}
+
+			wo := &types.SearchMessagesWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "search details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			query := rooms.SearchQuery{
+				Text:     wo.Details.Query,
+				AuthorID: wo.Details.AuthorID,
+				RoomSlug: wo.Details.Room,
+				Limit:    wo.Details.Limit,
+				Offset:   wo.Details.Offset,
+			}
+			if wo.Details.From != nil {
+				query.From = *wo.Details.From
+			}
+			if wo.Details.To != nil {
+				query.To = *wo.Details.To
+			}
+			found, err := s.roomsService.SearchMessages(visitor.User, query)
+			if err != nil {
+				s.handleError(ctx, searchErrorMessage(err), searchErrorStatus(err), err, visitor)
+				break
+			}
+			visitor.Notify(&types.Event{Event: "search_results", Data: found})
+
+		case "get_chat_history":
+			wo := &types.ChatHistoryWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "history details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			page, err := s.roomsService.ChatHistory(visitor, wo.Details.Before, wo.Details.After, wo.Details.Limit)
+			if err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			visitor.Notify(&types.Event{Event: "chat_history", Data: page})
+
 		case "set_user_password":
 			password := workOrder.Details.(map[string]interface{})["password"]
 			valid := validateUserPassword(password.(string))
@@ -416,9 +589,18 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 			err = s.userService.UpdateUserPassword(visitor.User.ID, password.(string))
 			if err != nil {
 				s.handleError(ctx, "", http.StatusInternalServerError, err, visitor)
+				break
+			}
+
+			// Reload the user, since having a password is what makes them registered in rooms
+			if user, err := s.userService.GetUserByID(visitor.User.ID); err == nil {
+				room.WithVisitor(visitor, func(v *rooms.Visitor) {
+					v.User = user
+				})
 			}
 
 			data := types.UserMessageData{
+				SentAt:       time.Now(),
 				Text:         "Password changed",
 				FromUserName: "ADMIN (to you)",
 				UserVerified: false,
@@ -450,7 +632,7 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
-			visitor.User.Name = name
+			visitor.SetName(name)
 
 			event := &types.Event{
 				Event: "user_name_change",
@@ -483,7 +665,9 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 					break
 				}
 
-				visitor.AddUser(user)
+				if !s.signIn(ctx, visitor, user) {
+					return
+				}
 				data := types.UserLoggedInData{
 					Name:        user.Name,
 					ID:          user.ID,
@@ -501,53 +685,497 @@ func (s *APIServer) serveWS(w http.ResponseWriter, r *http.Request) {
 					Event: "user_entered_chat",
 					Data:  user.Name,
 				}
-				visitor.Room.BroadcastEvent(event)
+				// Visitors waiting in the lobby are announced once they are admitted
+				if !visitor.InLobby() {
+					visitor.Room.BroadcastEvent(event)
+				}
 			}
 
 		case "identify_streamid":
-			for _, v := range visitor.Room.Visitors {
-				if v.StreamID == workOrder.Details.(string) {
-					data := &types.StreamIDUserNameData{
-						StreamID: workOrder.Details.(string),
-						Name:     v.User.Name,
-					}
+			streamID, _ := workOrder.Details.(string)
+			if name, ok := room.StreamOwnerName(streamID); ok {
+				data := &types.StreamIDUserNameData{
+					StreamID: streamID,
+					Name:     name,
+				}
 
-					event := &types.Event{
-						Event: "streamid_user_name",
-						Data:  data,
-					}
-					visitor.Room.BroadcastEvent(event)
-					break
+				event := &types.Event{
+					Event: "streamid_user_name",
+					Data:  data,
 				}
+				visitor.Room.BroadcastEvent(event)
 			}
 
-		case "get_current_guests":
-			guests := types.CurrentGuestsData{}
-			// Remove duplicates and own visitor
-			for _, v := range visitor.Room.Visitors {
-				if v.User != nil && visitor.User != nil {
-					guests = append(guests, types.CurrentGuest{
-						Name: v.User.Name, ID: v.User.ID,
-					})
-				}
+		case "list_rooms":
+			query, _ := workOrder.Details.(string)
+			entries, err := s.roomsService.Directory(query)
+			if err != nil {
+				s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+				break
 			}
-			deduped := utils.RemoveDuplicate(guests)
-			visitor.Notify(&types.Event{Event: "current_guests", Data: deduped})
-		}
+			visitor.Notify(&types.Event{Event: "rooms", Data: entries})
 
-	}
-}
+		case "subscribe", "unsubscribe":
+			if channel, _ := workOrder.Details.(string); channel != directoryChannel {
+				s.handleError(ctx, "unknown channel", http.StatusBadRequest, nil, visitor)
+				break
+			}
+			if workOrder.Order == "unsubscribe" {
+				s.directory.unsubscribe(visitor)
+				break
+			}
+			s.directory.subscribe(visitor)
 
-func (s *APIServer) handleError(ctx context.Context, message string, statusCode int, err error, visitor *rooms.Visitor) {
-	reqID, _ := utils.ExposeContextMetadata(ctx).Get("requestID")
+			entries, err := s.roomsService.Directory("")
+			if err != nil {
+				s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+				break
+			}
+			visitor.Notify(&types.Event{Event: "rooms", Data: entries})
 
-	if err == nil {
-		err = fmt.Errorf(message)
-	}
+		case "get_stats":
+			visitor.Notify(&types.Event{Event: "stats", Data: room.ConnectionQuality()})
 
-	if message == "" {
-		message = err.Error()
-	}
+		case "get_tracks":
+			visitor.Notify(&types.Event{Event: "tracks", Data: room.SFU.Tracks()})
+
+		case "start_egress", "stop_egress":
+			if !s.authorize(ctx, visitor, rooms.PermManageMedia) {
+				break
+			}
+
+			wo := &types.EgressWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "egress details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			if !s.egressAllowed(wo.Details.Address) {
+				s.handleError(ctx, "address is not a configured egress destination", http.StatusForbidden, nil, visitor)
+				break
+			}
+
+			if workOrder.Order == "start_egress" {
+				err = room.SFU.StartEgress(wo.Details.TrackID, wo.Details.Address)
+			} else {
+				err = room.SFU.StopEgress(wo.Details.TrackID, wo.Details.Address)
+			}
+			if err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			name := "room-" + utils.UintToString(room.ID)
+			visitor.Notify(&types.Event{Event: "egress_updated", Data: types.EgressData{
+				TrackID:  wo.Details.TrackID,
+				Address:  wo.Details.Address,
+				FileName: name + ".sdp",
+				SDP:      room.SFU.EgressSDP(name),
+			}})
+
+		case "publish_file":
+			if !s.authorize(ctx, visitor, rooms.PermManageMedia) {
+				break
+			}
+
+			wo := &types.PublishFileWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "publish details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			publisher, err := s.publishFiles(room, wo.Details)
+			if err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			visitor.Room.BroadcastEvent(&types.Event{Event: "file_publishing", Data: types.FilePublisherData{
+				StreamID: publisher.StreamID,
+				Video:    wo.Details.Video,
+				Audio:    wo.Details.Audio,
+			}})
+			room.OccupancyChanged()
+
+		case "stop_file":
+			if !s.authorize(ctx, visitor, rooms.PermManageMedia) {
+				break
+			}
+
+			streamID, _ := workOrder.Details.(string)
+			if err := room.SFU.StopPublisher(streamID); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusNotFound, err, visitor)
+				break
+			}
+			visitor.Room.BroadcastEvent(&types.Event{Event: "file_stopped", Data: types.FilePublisherData{StreamID: streamID}})
+			room.OccupancyChanged()
+
+		case "set_room_mode":
+			if !s.authorize(ctx, visitor, rooms.PermChangeMode) {
+				break
+			}
+
+			mode, _ := workOrder.Details.(string)
+			if err := s.roomsService.SetRoomMode(room, mode); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			// WHIP encoders aren't visitors, so the audience's are stopped here
+			s.whipSessions.closeWhere(room.ID, func(user *users.User) bool {
+				return !room.CanPublish(user)
+			})
+			room.BroadcastEvent(&types.Event{Event: "room_mode_changed", Data: types.RoomModeData{
+				Mode:       room.Mode,
+				Presenters: room.Presenters(),
+			}})
+
+		case "update_room":
+			if !s.authorize(ctx, visitor, rooms.PermEditRoom) {
+				break
+			}
+
+			wo := &types.UpdateRoomWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "room details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+			if wo.Details.Public != nil && !s.authorize(ctx, visitor, rooms.PermListRoom) {
+				break
+			}
+
+			if err := s.roomsService.UpdateRoom(room, wo.Details); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			room.BroadcastEvent(&types.Event{Event: "room_updated", Data: room.RoomData()})
+
+		case "set_schedule":
+			if !s.authorize(ctx, visitor, rooms.PermEditRoom) {
+				break
+			}
+
+			wo := &types.SetScheduleWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "schedule details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			if err := s.roomsService.SetSchedule(room, wo.Details); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			room.BroadcastEvent(&types.Event{Event: "room_updated", Data: room.RoomData()})
+			s.notifySchedule(ctx, visitor, room)
+
+		case "get_schedule":
+			if !s.authorize(ctx, visitor, rooms.PermEditRoom) {
+				break
+			}
+			s.notifySchedule(ctx, visitor, room)
+
+		case "create_breakouts":
+			if !s.authorize(ctx, visitor, rooms.PermBreakouts) {
+				break
+			}
+
+			wo := &types.CreateBreakoutsWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "breakout details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+			if wo.Details.Assignment == "" {
+				wo.Details.Assignment = rooms.BreakoutAssignRandom
+			}
+
+			if err := s.roomsService.CreateBreakouts(ctx, room, visitor.User.ID, wo.Details); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			room.NotifyPermitted(rooms.PermBreakouts, &types.Event{Event: "breakouts_updated", Data: s.roomsService.Breakouts(room)})
+
+		case "recall_breakouts":
+			if !s.authorize(ctx, visitor, rooms.PermBreakouts) {
+				break
+			}
+
+			wo := &types.RecallBreakoutsWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "recall details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			countdown := time.Duration(wo.Details.Countdown) * time.Second
+			if err := s.roomsService.RecallBreakouts(room, countdown); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+
+		case "get_breakouts":
+			if !s.authorize(ctx, visitor, rooms.PermBreakouts) {
+				break
+			}
+			visitor.Notify(&types.Event{Event: "breakouts_updated", Data: s.roomsService.Breakouts(room)})
+
+		case "set_role":
+			if !s.authorize(ctx, visitor, rooms.PermSetRoles) {
+				break
+			}
+
+			wo := &types.SetRoleWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "role details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+			role, err := rooms.ParseRole(wo.Details.Role)
+			if err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			if err := s.roomsService.SetRole(room, wo.Details.UserID, role); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			room.BroadcastEvent(&types.Event{Event: "roles_updated", Data: room.Roles()})
+
+		case "kick", "ban":
+			if !s.authorize(ctx, visitor, rooms.PermModerate) {
+				break
+			}
+
+			wo := &types.RemoveUserWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+			if !visitor.CanRemove(wo.Details.UserID) {
+				s.handleError(ctx, "you can not remove this user", http.StatusForbidden, nil, visitor)
+				break
+			}
+
+			banned := workOrder.Order == "ban"
+			if banned {
+				ban := &rooms.RoomBan{UserID: wo.Details.UserID, BannedByID: visitor.User.ID, Reason: wo.Details.Reason}
+				if wo.Details.Duration > 0 {
+					expiresAt := time.Now().Add(time.Duration(wo.Details.Duration) * time.Second)
+					ban.ExpiresAt = &expiresAt
+				}
+				if err := s.roomsService.BanUser(room, ban); err != nil {
+					s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+					break
+				}
+			}
+
+			removed := s.removeUser(room, wo.Details.UserID, wo.Details.Reason)
+			if !removed && !banned {
+				s.handleError(ctx, "user is not present", http.StatusBadRequest, nil, visitor)
+				break
+			}
+			room.BroadcastEvent(&types.Event{Event: "user_removed", Data: types.UserRemovedData{
+				UserID: wo.Details.UserID,
+				Reason: wo.Details.Reason,
+				Banned: banned,
+			}})
+
+		case "unban":
+			if !s.authorize(ctx, visitor, rooms.PermModerate) {
+				break
+			}
+
+			wo := &types.RemoveUserWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+			if err := s.roomsService.UnbanUser(room, wo.Details.UserID); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			fallthrough
+
+		case "get_bans":
+			if !s.authorize(ctx, visitor, rooms.PermModerate) {
+				break
+			}
+
+			bans, err := s.roomsService.Bans(room)
+			if err != nil {
+				s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+				break
+			}
+			data := []types.BanData{}
+			for _, ban := range bans {
+				data = append(data, ban.Data())
+			}
+			visitor.Notify(&types.Event{Event: "bans", Data: data})
+
+		case "admit", "deny":
+			if !s.authorize(ctx, visitor, rooms.PermAdmit) {
+				break
+			}
+
+			wo := &types.LobbyWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			if workOrder.Order == "deny" {
+				denied := room.Deny(wo.Details.UserID)
+				if len(denied) == 0 {
+					s.handleError(ctx, rooms.ErrNotInLobby.Error(), http.StatusBadRequest, rooms.ErrNotInLobby, visitor)
+					break
+				}
+				for _, v := range denied {
+					v.Client.Close()
+				}
+				break
+			}
+
+			user, err := s.roomsService.AdmitUser(room, wo.Details.UserID)
+			if errors.Is(err, rooms.ErrNotInLobby) {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			if err != nil {
+				// They are in, we just won't remember it next time
+				s.log.Error(err.Error())
+			}
+			room.BroadcastEvent(&types.Event{Event: "user_entered_chat", Data: user.Name})
+
+		case "get_lobby":
+			if !s.authorize(ctx, visitor, rooms.PermAdmit) {
+				break
+			}
+			visitor.Notify(&types.Event{Event: "lobby", Data: room.Lobby()})
+
+		case "set_slug":
+			// Vanity slugs are for registered owners, not everyone who can edit the room
+			if visitor.Role() != rooms.RoleOwner || visitor.User.Password == "" {
+				s.handleError(ctx, "only a registered owner can rename the room", http.StatusForbidden, nil, visitor)
+				break
+			}
+
+			slug, _ := workOrder.Details.(string)
+			err := s.roomsService.SetSlug(room, slug)
+			if errors.Is(err, rooms.ErrInvalidSlug) || errors.Is(err, rooms.ErrSlugTaken) {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			if err != nil {
+				s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+				break
+			}
+			room.BroadcastEvent(&types.Event{Event: "room_updated", Data: room.RoomData()})
+
+		case "create_invite":
+			if !s.authorize(ctx, visitor, rooms.PermInvite) {
+				break
+			}
+
+			wo := &types.CreateInviteWorkOrder{}
+			if err := json.Unmarshal(raw, wo); err != nil {
+				s.handleError(ctx, "invite details are not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+			if wo.Details.Role == "" {
+				wo.Details.Role = string(rooms.RoleMember)
+			}
+			role, err := rooms.ParseRole(wo.Details.Role)
+			if err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			// Only those who can hand out roles may invite people in above member
+			if role == rooms.RoleModerator && !s.authorize(ctx, visitor, rooms.PermSetRoles) {
+				break
+			}
+
+			expiresIn := time.Duration(wo.Details.ExpiresIn) * time.Second
+			token, invite, err := s.roomsService.CreateInvite(room, visitor.User.ID, role, expiresIn, wo.Details.MaxUses)
+			if err != nil {
+				s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+				break
+			}
+			visitor.Notify(&types.Event{Event: "invite_created", Data: types.InviteData{
+				Token:     token,
+				URL:       invitePath(room.Metadata().Slug, token),
+				RoomID:    room.ID,
+				Role:      string(invite.Role),
+				MaxUses:   invite.MaxUses,
+				ExpiresAt: invite.ExpiresAt,
+			}})
+
+		case "raise_hand", "lower_hand":
+			if visitor.User == nil {
+				s.handleError(ctx, "please log in first", http.StatusUnauthorized, nil, visitor)
+				break
+			}
+			if visitor.CanPublish() {
+				s.handleError(ctx, "you can already present", http.StatusBadRequest, nil, visitor)
+				break
+			}
+
+			raised := workOrder.Order == "raise_hand"
+			room.WithVisitor(visitor, func(v *rooms.Visitor) {
+				v.HandRaised = raised
+			})
+			event := "hand_lowered"
+			if raised {
+				event = "hand_raised"
+			}
+			room.NotifyPermitted(rooms.PermApproveHands, &types.Event{Event: event, Data: types.Visitor{ID: visitor.User.ID, Name: visitor.User.Name}})
+
+		case "approve_hand":
+			if !s.authorize(ctx, visitor, rooms.PermApproveHands) {
+				break
+			}
+
+			id, _ := workOrder.Details.(float64)
+			userID, err := utils.Float64ToUint(id)
+			if err != nil {
+				s.handleError(ctx, "user id is not valid", http.StatusBadRequest, err, visitor)
+				break
+			}
+
+			if err := s.admitPublisher(room); err != nil {
+				s.handleError(ctx, err.Error(), http.StatusServiceUnavailable, err, visitor)
+				break
+			}
+
+			promoted, pcs := room.PromoteRaisedHand(userID)
+			for _, pc := range pcs {
+				// Give them receivers for their media, which renegotiates with everyone
+				if err := room.SFU.EnablePublishing(pc); err != nil {
+					s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+				}
+			}
+			if !promoted {
+				s.handleError(ctx, "user does not have their hand raised", http.StatusNotFound, nil, visitor)
+				break
+			}
+			room.BroadcastEvent(&types.Event{Event: "presenters_updated", Data: room.Presenters()})
+
+		case "get_current_guests":
+			if visitor.User == nil {
+				break
+			}
+			visitor.Notify(&types.Event{Event: "current_guests", Data: room.Guests()})
+		}
+
+	}
+}
+
+func (s *APIServer) handleError(ctx context.Context, message string, statusCode int, err error, visitor *rooms.Visitor) {
+	reqID, _ := utils.ExposeContextMetadata(ctx).Get("requestID")
+
+	if err == nil {
+		err = fmt.Errorf(message)
+	}
+
+	if message == "" {
+		message = err.Error()
+	}
 
 	s.log.LogRequestError(reqID.(string), err.Error(), http.StatusInternalServerError)
 	data := &types.ErrorData{
@@ -564,6 +1192,202 @@ func (s *APIServer) handleError(ctx context.Context, message string, statusCode
 	}
 }
 
+// signIn attaches a user to the visitor, turning them away if they are banned from the room.
+// Visitors are only shown the room the first time they sign in. When it reports false the socket should be closed.
+func (s *APIServer) signIn(ctx context.Context, visitor *rooms.Visitor, user *users.User) bool {
+	// Visitors waiting in the lobby are shown the room when they are admitted
+	joining := visitor.User == nil && !visitor.InLobby()
+	err := visitor.AddUser(user)
+	if errors.Is(err, rooms.ErrBanned) || errors.Is(err, rooms.ErrInviteInvalid) {
+		s.handleError(ctx, err.Error(), http.StatusForbidden, err, visitor)
+		return false
+	}
+	if err != nil {
+		s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+		return false
+	}
+	if joining {
+		visitor.Notify(&types.Event{Event: "joined_room", Data: visitor.Room.JoinedRoomData(user)})
+	}
+	return true
+}
+
+// signInNewUser gives a visitor without a usable access token a new user and signs them in with it.
+// When it reports false the socket should be closed.
+func (s *APIServer) signInNewUser(ctx context.Context, visitor *rooms.Visitor) bool {
+	user, accessToken, err := s.userService.CreateUser(false)
+	if err != nil {
+		s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+		return false
+	}
+	if !s.signIn(ctx, visitor, user) {
+		return false
+	}
+
+	data := types.UserLoggedInData{
+		Name:        user.Name,
+		ID:          user.ID,
+		AccessToken: accessToken,
+	}
+
+	event := &types.Event{
+		Event: "user_logged_in",
+		Data:  data,
+	}
+
+	visitor.Notify(event)
+	visitor.Clarify("credentials")
+
+	event = &types.Event{
+		Event: "user_entered_chat",
+		Data:  user.Name,
+	}
+	// Visitors waiting in the lobby are announced once they are admitted
+	if !visitor.InLobby() {
+		visitor.Room.BroadcastEvent(event)
+	}
+	return true
+}
+
+// admitPublisher checks a room has space for one more publisher. Browsers and WHIP encoders share the limit.
+func (s *APIServer) admitPublisher(room *rooms.ChatRoom) error {
+	if room.SFU.CountPublishers() >= s.cfg.MaxPeerConnections {
+		return errPublisherLimit
+	}
+	return nil
+}
+
+// removeUser closes every connection a user has to the room, websocket, PeerConnection and WHIP alike.
+// It reports whether the user had any.
+func (s *APIServer) removeUser(room *rooms.ChatRoom, userID uint, reason string) bool {
+	kicked, pcs := room.Kick(userID, reason)
+	for _, pc := range pcs {
+		if err := pc.Close(); err != nil {
+			s.log.Error(err.Error())
+		}
+	}
+	for _, v := range kicked {
+		v.Client.Close()
+	}
+	closed := s.whipSessions.closeUser(room.ID, userID)
+	return len(kicked) > 0 || closed
+}
+
+// checkRoomAccess enforces a room's passcode and invites on the way in, returning the invite that
+// still needs redeeming once we know who is using it. user is who sent the request, if they said.
+// Hosts signed in with an access token don't need either.
+func (s *APIServer) checkRoomAccess(r *http.Request, room *rooms.ChatRoom, user *users.User) (string, error) {
+	query := r.URL.Query()
+	if user != nil && room.Allows(user, rooms.PermAdmit) {
+		return "", nil
+	}
+	var userID uint
+	if user != nil {
+		userID = user.ID
+	}
+	invite := query.Get("invite")
+	return invite, s.roomsService.CheckAccess(room, query.Get("passcode"), invite, userID)
+}
+
+// notifySchedule sends a host the room's schedule along with its invitees
+func (s *APIServer) notifySchedule(ctx context.Context, visitor *rooms.Visitor, room *rooms.ChatRoom) {
+	invitees, err := s.roomsService.Invitees(room)
+	if err != nil {
+		s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+		return
+	}
+	schedule := room.Metadata().Schedule.Data()
+	schedule.Invitees = invitees
+	visitor.Notify(&types.Event{Event: "schedule", Data: schedule})
+}
+
+// authorize is the check every privileged work order goes through. It tells the visitor when their role falls short.
+func (s *APIServer) authorize(ctx context.Context, visitor *rooms.Visitor, permission rooms.Permission) bool {
+	if visitor.Can(permission) {
+		return true
+	}
+	s.handleError(ctx, permissionDenied(permission), http.StatusForbidden, nil, visitor)
+	return false
+}
+
+// handleMessageError reports why a message could not be changed or reacted to
+func (s *APIServer) handleMessageError(ctx context.Context, err error, visitor *rooms.Visitor) {
+	switch {
+	case errors.Is(err, rooms.ErrMessageNotFound):
+		s.handleError(ctx, err.Error(), http.StatusNotFound, err, visitor)
+	case errors.Is(err, rooms.ErrNotAuthor):
+		s.handleError(ctx, err.Error(), http.StatusForbidden, err, visitor)
+	case errors.Is(err, rooms.ErrEmptyEdit), errors.Is(err, rooms.ErrInvalidEmoji), errors.Is(err, rooms.ErrNoReaction),
+		errors.Is(err, rooms.ErrNestedReply), errors.Is(err, rooms.ErrPageSize):
+		s.handleError(ctx, err.Error(), http.StatusBadRequest, err, visitor)
+	default:
+		s.handleError(ctx, "internal server error", http.StatusInternalServerError, err, visitor)
+	}
+}
+
+// permissionDenied tells someone which permission their role lacks
+func permissionDenied(permission rooms.Permission) string {
+	return fmt.Sprintf("your role in this room does not allow %s", strings.ReplaceAll(string(permission), "_", " "))
+}
+
+// forwardTrack copies a publisher's packets to the room's local track until the publisher goes away
+func (s *APIServer) forwardTrack(room *rooms.ChatRoom, t *webrtc.TrackRemote, trackLocal *webrtc.TrackLocalStaticRTP) {
+	room.OccupancyChanged()
+	defer room.OccupancyChanged()
+	defer room.SFU.RemoveTrack(trackLocal)
+
+	buf := make([]byte, 1500)
+	for {
+		i, _, err := t.Read(buf)
+		if err != nil {
+			s.log.Error(err.Error())
+			return
+		}
+
+		if _, err = trackLocal.Write(buf[:i]); err != nil {
+			s.log.Error(err.Error())
+			return
+		}
+
+		room.SFU.Egress(t.ID(), buf[:i])
+	}
+}
+
+// egressAllowed only lets media be forwarded to addresses listed in config
+func (s *APIServer) egressAllowed(address string) bool {
+	for _, allowed := range strings.Split(s.cfg.EgressAddrs, ",") {
+		if address != "" && strings.TrimSpace(allowed) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// publishFiles plays files from the configured media directory into a room
+func (s *APIServer) publishFiles(room *rooms.ChatRoom, details types.PublishFileWorkOrderDetail) (*sfu.FilePublisher, error) {
+	return room.SFU.PublishFiles(s.mediaPath(details.Video), s.mediaPath(details.Audio), details.Loop)
+}
+
+// mediaPath keeps file names inside the media directory
+func (s *APIServer) mediaPath(name string) string {
+	if name == "" {
+		return ""
+	}
+	return filepath.Join(s.cfg.MediaDir, filepath.Base(name))
+}
+
+// handleHTTPError logs an error for a plain HTTP request and writes it as the response
+func (s *APIServer) handleHTTPError(ctx context.Context, w http.ResponseWriter, message string, statusCode int, err error) {
+	reqID, _ := utils.ExposeContextMetadata(ctx).Get("requestID")
+
+	if err == nil {
+		err = fmt.Errorf(message)
+	}
+
+	s.log.LogRequestError(reqID.(string), err.Error(), statusCode)
+	http.Error(w, message, statusCode)
+}
+
 func validateUserPassword(password string) bool {
 	var (
 		hasCorrectLen = false
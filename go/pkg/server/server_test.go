@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/config"
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"github.com/Embiggenerd/spiritio/pkg/logger"
+	"github.com/Embiggenerd/spiritio/pkg/rooms"
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/types"
+	"github.com/gorilla/websocket"
+)
+
+// TestValidateTokenOfMissingUser signs in a visitor whose token is valid but whose user is gone as a new user
+func TestValidateTokenOfMissingUser(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Defaults()
+	log := &logger.CustomLogger{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	roomsService := rooms.NewRoomsService(ctx, cfg, log, database)
+	usersService := users.NewUsersService(ctx, cfg, log, database)
+	s := NewServer(ctx, cfg, log, roomsService, usersService)
+
+	room, err := roomsService.CreateRoom(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roomsService.CloseRoom(room, "test over")
+	gone, accessToken, err := usersService.CreateUser(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.DB.Delete(&users.User{}, gone.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(log.LoggingMW(http.HandlerFunc(s.serveWS)))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?room="+room.Slug, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	newUser := validateToken(t, conn, accessToken)
+	if newUser.ID == 0 || newUser.ID == gone.ID || newUser.AccessToken == "" {
+		t.Fatalf("visitor was not given a new user: %+v", newUser)
+	}
+	// The socket is still in use once the visitor has their new user
+	if again := validateToken(t, conn, newUser.AccessToken); again.ID != newUser.ID {
+		t.Errorf("signing in with the new token gave user %d, want %d", again.ID, newUser.ID)
+	}
+}
+
+// validateToken sends an access token the way the client does on joining and returns who it was signed in as
+func validateToken(t *testing.T, conn *websocket.Conn, accessToken string) types.UserLoggedInData {
+	t.Helper()
+	if err := conn.WriteJSON(types.WorkOrder{Order: "validate_access_token", Details: accessToken}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var message struct {
+			Data struct {
+				Event string          `json:"event"`
+				Data  json.RawMessage `json:"data"`
+			} `json:"data"`
+		}
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("socket closed before the visitor was signed in: %v", err)
+		}
+		if message.Data.Event != "user_logged_in" {
+			continue
+		}
+		data := types.UserLoggedInData{}
+		if err := json.Unmarshal(message.Data.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Embiggenerd/spiritio/pkg/rooms"
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/pion/webrtc/v4"
+)
+
+// serveWHEP implements WHEP playback so players can watch a room over HTTP signaling alone.
+// Viewers are receive-only: they are not visitors and don't count toward the publisher limit.
+//
+//	POST   /whep/{room}             SDP offer in, SDP answer out
+//	DELETE /whep/{room}/{sessionID} tear the session down
+func (s *APIServer) serveWHEP(w http.ResponseWriter, r *http.Request) {
+	roomSlug, sessionID, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/whep/"), "/")
+
+	switch r.Method {
+	case http.MethodPost:
+		if sessionID != "" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.whepSubscribe(w, r, roomSlug)
+
+	case http.MethodDelete:
+		s.deleteHTTPSession(w, r, &s.whepSessions, roomSlug, sessionID)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *APIServer) whepSubscribe(w http.ResponseWriter, r *http.Request, roomSlug string) {
+	ctx := r.Context()
+
+	// Viewers don't need an account, but a token that is sent must be valid
+	var user *users.User
+	if r.Header.Get("Authorization") != "" {
+		var err error
+		user, err = s.bearerUser(r)
+		if err != nil {
+			s.handleHTTPError(ctx, w, "unauthorized", http.StatusUnauthorized, err)
+			return
+		}
+	}
+
+	room, offer, ok := s.readOffer(w, r, roomSlug, user)
+	if !ok {
+		return
+	}
+
+	if user != nil {
+		if err := s.roomsService.CheckBan(room.ID, user.ID); err != nil {
+			s.handleHTTPError(ctx, w, err.Error(), http.StatusForbidden, err)
+			return
+		}
+	}
+	// Viewers can't wait in the lobby, so while it is holding people only hosts who could admit them may watch
+	if room.Holding() && (user == nil || !room.Allows(user, rooms.PermAdmit)) {
+		s.handleHTTPError(ctx, w, "this room is not open to viewers yet", http.StatusForbidden, nil)
+		return
+	}
+
+	if room.SFU.CountViewers() >= s.cfg.MaxViewers {
+		s.handleHTTPError(ctx, w, "room has reached its viewer limit", http.StatusServiceUnavailable, nil)
+		return
+	}
+
+	peerConnection, err := room.SFU.CreateViewerPeerConnection(offer)
+	if err != nil {
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return
+	}
+
+	answer, err := s.answerHTTPOffer(peerConnection, offer)
+	if err != nil {
+		peerConnection.Close()
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return
+	}
+
+	id := s.whepSessions.add(&httpSession{roomID: room.ID, user: user, peerConnection: peerConnection})
+	peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		switch p {
+		case webrtc.PeerConnectionStateConnected:
+			room.SFU.DispatchKeyFrame()
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.whepSessions.remove(id)
+			peerConnection.Close()
+		}
+	})
+
+	writeSDP(w, "/whep/"+roomSlug+"/"+id, answer)
+}
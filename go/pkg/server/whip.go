@@ -0,0 +1,310 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Embiggenerd/spiritio/pkg/rooms"
+	"github.com/Embiggenerd/spiritio/pkg/users"
+	"github.com/Embiggenerd/spiritio/types"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// httpSessions holds PeerConnections that were signaled over HTTP, keyed by the id in their resource URL
+type httpSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*httpSession
+}
+
+type httpSession struct {
+	roomID uint
+	// user is who the session belongs to, nil for anonymous viewers
+	user           *users.User
+	peerConnection *webrtc.PeerConnection
+}
+
+func (h *httpSessions) add(session *httpSession) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions == nil {
+		h.sessions = map[string]*httpSession{}
+	}
+	id := uuid.NewString()
+	h.sessions[id] = session
+	return id
+}
+
+func (h *httpSessions) get(id string) (*httpSession, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	session, ok := h.sessions[id]
+	return session, ok
+}
+
+func (h *httpSessions) remove(id string) (*httpSession, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	session, ok := h.sessions[id]
+	delete(h.sessions, id)
+	return session, ok
+}
+
+// closeUser closes every session a user has in a room, reporting whether there were any
+func (h *httpSessions) closeUser(roomID, userID uint) bool {
+	return h.closeWhere(roomID, func(user *users.User) bool {
+		return user != nil && user.ID == userID
+	})
+}
+
+// closeWhere closes the sessions in a room whose user matches, reporting whether there were any
+func (h *httpSessions) closeWhere(roomID uint, match func(user *users.User) bool) bool {
+	h.mu.Lock()
+	closing := []*httpSession{}
+	for id, session := range h.sessions {
+		if session.roomID == roomID && match(session.user) {
+			closing = append(closing, session)
+			delete(h.sessions, id)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, session := range closing {
+		session.peerConnection.Close()
+	}
+	return len(closing) > 0
+}
+
+// serveWHIP implements WHIP ingest (RFC 9725) so encoders like OBS can publish into a room.
+//
+//	POST   /whip/{room}             SDP offer in, SDP answer out
+//	DELETE /whip/{room}/{sessionID} tear the session down
+func (s *APIServer) serveWHIP(w http.ResponseWriter, r *http.Request) {
+	roomSlug, sessionID, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/whip/"), "/")
+
+	switch r.Method {
+	case http.MethodPost:
+		if sessionID != "" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.whipPublish(w, r, roomSlug)
+
+	case http.MethodDelete:
+		s.deleteHTTPSession(w, r, &s.whipSessions, roomSlug, sessionID)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *APIServer) whipPublish(w http.ResponseWriter, r *http.Request, roomSlug string) {
+	ctx := r.Context()
+
+	user, err := s.bearerUser(r)
+	if err != nil {
+		s.handleHTTPError(ctx, w, "unauthorized", http.StatusUnauthorized, err)
+		return
+	}
+
+	room, offer, ok := s.readOffer(w, r, roomSlug, user)
+	if !ok {
+		return
+	}
+
+	if err := s.roomsService.CheckBan(room.ID, user.ID); err != nil {
+		s.handleHTTPError(ctx, w, err.Error(), http.StatusForbidden, err)
+		return
+	}
+	if !room.CanPublish(user) {
+		s.handleHTTPError(ctx, w, "only presenters can publish in a webinar", http.StatusForbidden, nil)
+		return
+	}
+	if err := s.admitPublisher(room); err != nil {
+		s.handleHTTPError(ctx, w, err.Error(), http.StatusServiceUnavailable, err)
+		return
+	}
+
+	peerConnection, err := room.SFU.CreateIngestPeerConnection()
+	if err != nil {
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return
+	}
+
+	peerConnection.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if t.Kind() == webrtc.RTPCodecTypeVideo && !room.Metadata().Settings.VideoEnabled {
+			return
+		}
+
+		trackLocal := room.SFU.AddTrack(t)
+		room.BroadcastEvent(&types.Event{Event: "streamid_user_name", Data: &types.StreamIDUserNameData{
+			StreamID: trackLocal.StreamID(),
+			Name:     user.Name,
+		}})
+		s.forwardTrack(room, t, trackLocal)
+	})
+
+	answer, err := s.answerHTTPOffer(peerConnection, offer)
+	if err != nil {
+		peerConnection.Close()
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return
+	}
+
+	id := s.whipSessions.add(&httpSession{roomID: room.ID, user: user, peerConnection: peerConnection})
+	peerConnection.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		if p == webrtc.PeerConnectionStateFailed || p == webrtc.PeerConnectionStateClosed {
+			s.whipSessions.remove(id)
+			peerConnection.Close()
+		}
+	})
+
+	writeSDP(w, "/whip/"+roomSlug+"/"+id, answer)
+}
+
+// bearerUser authenticates an HTTP request with the same JWTs that the websocket hands out
+func (s *APIServer) bearerUser(r *http.Request) (*users.User, error) {
+	tokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return nil, errors.New("missing bearer token")
+	}
+	return s.tokenUser(tokenString)
+}
+
+// requestUser authenticates a request by its bearer token, or failing that an access_token query parameter,
+// which is the only way a websocket can send one before it is upgraded
+func (s *APIServer) requestUser(r *http.Request) (*users.User, error) {
+	if user, err := s.bearerUser(r); err == nil {
+		return user, nil
+	}
+	tokenString := r.URL.Query().Get("access_token")
+	if tokenString == "" {
+		return nil, errors.New("missing access token")
+	}
+	return s.tokenUser(tokenString)
+}
+
+func (s *APIServer) tokenUser(tokenString string) (*users.User, error) {
+	token, err := s.userService.ValidateAccessToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	return s.userService.GetUserFromAccessToken(token)
+}
+
+// readOffer looks up the room, lets user in with any invite they brought and reads the SDP offer from the request body
+func (s *APIServer) readOffer(w http.ResponseWriter, r *http.Request, roomSlug string, user *users.User) (*rooms.ChatRoom, webrtc.SessionDescription, bool) {
+	ctx := r.Context()
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer}
+
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/sdp" {
+		s.handleHTTPError(ctx, w, "content type must be application/sdp", http.StatusUnsupportedMediaType, nil)
+		return nil, offer, false
+	}
+
+	room, err := s.roomsService.GetRoomBySlug(roomSlug)
+	if errors.Is(err, rooms.ErrRoomNotFound) {
+		s.handleHTTPError(ctx, w, err.Error(), http.StatusNotFound, err)
+		return nil, offer, false
+	}
+	if err != nil {
+		s.handleHTTPError(ctx, w, "internal server error", http.StatusInternalServerError, err)
+		return nil, offer, false
+	}
+	invite, err := s.checkRoomAccess(r, room, user)
+	if err != nil {
+		s.handleHTTPError(ctx, w, err.Error(), http.StatusForbidden, err)
+		return nil, offer, false
+	}
+	if invite != "" {
+		// Retries by the same user don't use the invite up again
+		var userID uint
+		if user != nil {
+			userID = user.ID
+		}
+		if _, err := s.roomsService.RedeemInvite(room, invite, userID); err != nil {
+			s.handleHTTPError(ctx, w, err.Error(), http.StatusForbidden, err)
+			return nil, offer, false
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		s.handleHTTPError(ctx, w, "could not read offer", http.StatusBadRequest, err)
+		return nil, offer, false
+	}
+	offer.SDP = string(body)
+
+	if err := room.SFU.ValidateCodecs(offer); err != nil {
+		s.handleHTTPError(ctx, w, err.Error(), http.StatusNotAcceptable, err)
+		return nil, offer, false
+	}
+	return room, offer, true
+}
+
+// answerHTTPOffer answers an offer with every ICE candidate included, since HTTP signaling has no trickle
+func (s *APIServer) answerHTTPOffer(peerConnection *webrtc.PeerConnection, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return nil, err
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+	<-gatherComplete
+
+	return peerConnection.LocalDescription(), nil
+}
+
+// deleteHTTPSession tears down a session in the room it was created in. Sessions that belong to
+// a user can only be torn down with that user's bearer token.
+func (s *APIServer) deleteHTTPSession(w http.ResponseWriter, r *http.Request, sessions *httpSessions, roomSlug, sessionID string) {
+	ctx := r.Context()
+	session, ok := sessions.get(sessionID)
+	if ok {
+		room, err := s.roomsService.GetRoomBySlug(roomSlug)
+		ok = err == nil && room.ID == session.roomID
+	}
+	if !ok {
+		s.handleHTTPError(ctx, w, "session not found", http.StatusNotFound, nil)
+		return
+	}
+
+	if session.user != nil {
+		user, err := s.bearerUser(r)
+		if err != nil {
+			s.handleHTTPError(ctx, w, "unauthorized", http.StatusUnauthorized, err)
+			return
+		}
+		if user.ID != session.user.ID {
+			s.handleHTTPError(ctx, w, "this session belongs to someone else", http.StatusForbidden, nil)
+			return
+		}
+	}
+
+	if _, ok := sessions.remove(sessionID); !ok {
+		s.handleHTTPError(ctx, w, "session not found", http.StatusNotFound, nil)
+		return
+	}
+	if err := session.peerConnection.Close(); err != nil {
+		s.log.Error(err.Error())
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeSDP(w http.ResponseWriter, location string, answer *webrtc.SessionDescription) {
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer.SDP)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Embiggenerd/spiritio/pkg/config"
+	"github.com/Embiggenerd/spiritio/pkg/rooms"
+	"github.com/Embiggenerd/spiritio/pkg/sfu"
+)
+
+// TestAdmitPublisherCountsIngest holds WHIP encoders to the same publisher limit as browsers
+func TestAdmitPublisherCountsIngest(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.MaxPeerConnections = 1
+	s := &APIServer{cfg: cfg}
+	unit, err := sfu.NewSelectiveForwardingUnit(cfg.CodecPolicy(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := &rooms.ChatRoom{SFU: unit}
+	defer room.SFU.Close()
+
+	if err := s.admitPublisher(room); err != nil {
+		t.Fatalf("an empty room turned a publisher away: %v", err)
+	}
+	if _, err := room.SFU.CreateIngestPeerConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.admitPublisher(room); !errors.Is(err, errPublisherLimit) {
+		t.Errorf("a full room admitted another publisher: %v", err)
+	}
+}
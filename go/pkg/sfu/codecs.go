@@ -0,0 +1,133 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Embiggenerd/spiritio/pkg/config"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+var ErrIncompatibleCodecs = errors.New("no compatible codecs")
+
+var videoRTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+
+// videoCodecs are Pion's default video codecs keyed by the names used in config, with their rtx payload types
+var videoCodecs = map[string][]webrtc.RTPCodecParameters{
+	"vp8": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: "apt=96"}, PayloadType: 97},
+	},
+	"h264": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: videoRTCPFeedback}, PayloadType: 102},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: "apt=102"}, PayloadType: 103},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: videoRTCPFeedback}, PayloadType: 106},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: "apt=106"}, PayloadType: 107},
+	},
+	"vp9": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: videoRTCPFeedback}, PayloadType: 98},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: "apt=98"}, PayloadType: 99},
+	},
+	"av1": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback}, PayloadType: 45},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: "apt=45"}, PayloadType: 46},
+	},
+}
+
+var audioCodecs = map[string]webrtc.RTPCodecParameters{
+	"g722": {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000}, PayloadType: 9},
+	"pcmu": {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0},
+	"pcma": {RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, PayloadType: 8},
+}
+
+// opusCodec builds the Opus codec with the DTX and FEC parameters from the policy
+func opusCodec(policy config.CodecPolicy) webrtc.RTPCodecParameters {
+	fmtp := "minptime=10"
+	if policy.OpusFEC {
+		fmtp += ";useinbandfec=1"
+	}
+	if policy.OpusDTX {
+		fmtp += ";usedtx=1"
+	}
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: fmtp},
+		PayloadType:        111,
+	}
+}
+
+// newAPI creates a webrtc API whose MediaEngine only negotiates the codecs in the policy, in order
+func newAPI(policy config.CodecPolicy) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+
+	for _, name := range policy.AudioCodecs {
+		name = strings.ToLower(name)
+		codec, ok := audioCodecs[name]
+		if name == "opus" {
+			codec, ok = opusCodec(policy), true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown audio codec: %s", name)
+		}
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range policy.VideoCodecs {
+		codecs, ok := videoCodecs[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown video codec: %s", name)
+		}
+		for _, codec := range codecs {
+			if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)), nil
+}
+
+// ValidateCodecs rejects a description that has no codec in common with the room's policy for a media section
+func (s *SFUService) ValidateCodecs(desc webrtc.SessionDescription) error {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return err
+	}
+
+	for _, md := range parsed.MediaDescriptions {
+		kind := md.MediaName.Media
+		allowed := s.policy.AudioCodecs
+		if kind == "video" {
+			allowed = s.policy.VideoCodecs
+		} else if kind != "audio" {
+			continue
+		}
+
+		supported := false
+		for _, a := range md.Attributes {
+			if a.Key != "rtpmap" {
+				continue
+			}
+			_, encoding, _ := strings.Cut(a.Value, " ")
+			name, _, _ := strings.Cut(encoding, "/")
+			for _, codec := range allowed {
+				if strings.EqualFold(name, codec) {
+					supported = true
+				}
+			}
+		}
+
+		if !supported {
+			return fmt.Errorf("%w: this room accepts %s %s", ErrIncompatibleCodecs, kind, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Embiggenerd/spiritio/types"
+	"github.com/pion/webrtc/v4"
+)
+
+var (
+	ErrEgressNotFound   = errors.New("egress not found")
+	ErrEgressLocalTrack = errors.New("tracks played from files can not be forwarded, only tracks published by peers")
+)
+
+// egressSink copies a track's RTP packets, unchanged, to a UDP address
+type egressSink struct {
+	trackID string
+	kind    webrtc.RTPCodecType
+	codec   webrtc.RTPCodecParameters
+	addr    *net.UDPAddr
+	conn    *net.UDPConn
+}
+
+// StartEgress forwards a track as plain RTP to address
+func (s *SFUService) StartEgress(trackID, address string) error {
+	s.ListLock.RLock()
+	info, ok := s.trackInfos[trackID]
+	s.ListLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("track %s is not being published", trackID)
+	}
+	// Egress copies the RTP packets a peer sent, and file tracks have none
+	if info.local {
+		return ErrEgressLocalTrack
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	s.egressLock.Lock()
+	defer s.egressLock.Unlock()
+	for _, sink := range s.egressSinks[trackID] {
+		if sink.addr.String() == addr.String() {
+			conn.Close()
+			return nil
+		}
+	}
+	s.egressSinks[trackID] = append(s.egressSinks[trackID], &egressSink{
+		trackID: trackID,
+		kind:    info.kind,
+		codec:   info.codec,
+		addr:    addr,
+		conn:    conn,
+	})
+	return nil
+}
+
+// StopEgress stops forwarding a track to address
+func (s *SFUService) StopEgress(trackID, address string) error {
+	// Sinks are keyed by resolved address, so hostnames match what StartEgress stored
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	s.egressLock.Lock()
+	defer s.egressLock.Unlock()
+
+	sinks := s.egressSinks[trackID]
+	for i, sink := range sinks {
+		if sink.addr.String() == addr.String() {
+			sink.conn.Close()
+			s.egressSinks[trackID] = append(sinks[:i], sinks[i+1:]...)
+			return nil
+		}
+	}
+	return ErrEgressNotFound
+}
+
+// Egress writes a packet read from a published track to every sink forwarding it
+func (s *SFUService) Egress(trackID string, packet []byte) {
+	s.egressLock.RLock()
+	defer s.egressLock.RUnlock()
+
+	for _, sink := range s.egressSinks[trackID] {
+		// UDP sinks are best effort, a missing listener must not stall the track
+		sink.conn.Write(packet)
+	}
+}
+
+// stopTrackEgress closes every sink for a track that is no longer published
+func (s *SFUService) stopTrackEgress(trackID string) {
+	s.egressLock.Lock()
+	defer s.egressLock.Unlock()
+
+	for _, sink := range s.egressSinks[trackID] {
+		sink.conn.Close()
+	}
+	delete(s.egressSinks, trackID)
+}
+
+// EgressSDP describes every active sink so tools like ffmpeg and GStreamer can receive them
+func (s *SFUService) EgressSDP(name string) string {
+	s.egressLock.RLock()
+	defer s.egressLock.RUnlock()
+
+	var b strings.Builder
+	b.WriteString("v=0\r\n")
+	b.WriteString("o=- 0 0 IN IP4 127.0.0.1\r\n")
+	b.WriteString("s=" + name + "\r\n")
+	b.WriteString("t=0 0\r\n")
+
+	for _, sinks := range s.egressSinks {
+		for _, sink := range sinks {
+			ipVersion := "IP4"
+			if sink.addr.IP.To4() == nil {
+				ipVersion = "IP6"
+			}
+			// rtpmap encoding names drop the "video/" or "audio/" prefix
+			_, encoding, _ := strings.Cut(sink.codec.MimeType, "/")
+			rtpmap := fmt.Sprintf("%d %s/%d", sink.codec.PayloadType, encoding, sink.codec.ClockRate)
+			if sink.codec.Channels > 0 {
+				rtpmap += fmt.Sprintf("/%d", sink.codec.Channels)
+			}
+
+			fmt.Fprintf(&b, "m=%s %d RTP/AVP %d\r\n", sink.kind.String(), sink.addr.Port, sink.codec.PayloadType)
+			fmt.Fprintf(&b, "c=IN %s %s\r\n", ipVersion, sink.addr.IP.String())
+			b.WriteString("a=rtpmap:" + rtpmap + "\r\n")
+			if sink.codec.SDPFmtpLine != "" {
+				fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", sink.codec.PayloadType, sink.codec.SDPFmtpLine)
+			}
+			b.WriteString("a=recvonly\r\n")
+		}
+	}
+	return b.String()
+}
+
+// Tracks lists every track currently published into the SFU
+func (s *SFUService) Tracks() []types.TrackData {
+	s.ListLock.RLock()
+	defer s.ListLock.RUnlock()
+
+	tracks := []types.TrackData{}
+	for id, info := range s.trackInfos {
+		tracks = append(tracks, types.TrackData{
+			ID:       id,
+			StreamID: info.streamID,
+			Kind:     info.kind.String(),
+			MimeType: info.codec.MimeType,
+		})
+	}
+	return tracks
+}
@@ -0,0 +1,233 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+var ErrPublisherNotFound = errors.New("publisher not found")
+
+// FilePublisher plays pre-recorded IVF (VP8) and Ogg (Opus) files into the SFU without a browser
+type FilePublisher struct {
+	StreamID string
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Stop ends playback, removing the publisher's tracks from the SFU
+func (p *FilePublisher) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// PublishFiles starts playing a video file, an audio file, or both as a single stream.
+// With loop set, playback restarts from the beginning until the publisher is stopped.
+func (s *SFUService) PublishFiles(videoPath, audioPath string, loop bool) (*FilePublisher, error) {
+	if videoPath == "" && audioPath == "" {
+		return nil, errors.New("no file to publish")
+	}
+
+	p := &FilePublisher{
+		StreamID: "bot-" + uuid.NewString(),
+		stop:     make(chan struct{}),
+	}
+
+	var tracks []*webrtc.TrackLocalStaticSample
+	if videoPath != "" {
+		if err := s.checkPublishable(videoPath, webrtc.MimeTypeVP8, s.policy.VideoCodecs, readIVFHeader); err != nil {
+			return nil, err
+		}
+		track, err := webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, p.StreamID+"-video", p.StreamID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+		p.wg.Add(1)
+		go p.play(videoPath, loop, func(f *os.File) error { return playIVF(f, track, p.stop) })
+	}
+
+	if audioPath != "" {
+		if err := s.checkPublishable(audioPath, webrtc.MimeTypeOpus, s.policy.AudioCodecs, readOggHeader); err != nil {
+			p.Stop()
+			return nil, err
+		}
+		track, err := webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, p.StreamID+"-audio", p.StreamID,
+		)
+		if err != nil {
+			p.Stop()
+			return nil, err
+		}
+		tracks = append(tracks, track)
+		p.wg.Add(1)
+		go p.play(audioPath, loop, func(f *os.File) error { return playOgg(f, track, p.stop) })
+	}
+
+	s.ListLock.Lock()
+	s.publishers[p.StreamID] = p
+	s.ListLock.Unlock()
+
+	for _, track := range tracks {
+		s.AddLocalTrack(track, track.Kind(), webrtc.RTPCodecParameters{RTPCodecCapability: track.Codec()})
+	}
+
+	// Once every file has finished playing, take the tracks back out of the room
+	go func() {
+		p.wg.Wait()
+		for _, track := range tracks {
+			s.RemoveTrack(track)
+		}
+		s.ListLock.Lock()
+		delete(s.publishers, p.StreamID)
+		s.ListLock.Unlock()
+	}()
+
+	return p, nil
+}
+
+// StopPublisher stops a file publisher by its stream ID
+func (s *SFUService) StopPublisher(streamID string) error {
+	s.ListLock.RLock()
+	p, ok := s.publishers[streamID]
+	s.ListLock.RUnlock()
+	if !ok {
+		return ErrPublisherNotFound
+	}
+	p.Stop()
+	return nil
+}
+
+// checkPublishable makes sure the file can be read and the room's codec policy allows its codec
+func (s *SFUService) checkPublishable(path, mimeType string, allowed []string, readHeader func(io.Reader) error) error {
+	_, codec, _ := strings.Cut(mimeType, "/")
+	supported := false
+	for _, c := range allowed {
+		if strings.EqualFold(c, codec) {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("%w: this room does not accept %s", ErrIncompatibleCodecs, codec)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readHeader(f)
+}
+
+func (p *FilePublisher) play(path string, loop bool, playFile func(f *os.File) error) {
+	defer p.wg.Done()
+	for {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		err = playFile(f)
+		f.Close()
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Println(err)
+			return
+		}
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if !loop {
+			return
+		}
+	}
+}
+
+func readIVFHeader(r io.Reader) error {
+	_, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return err
+	}
+	if header.FourCC != "VP80" {
+		return fmt.Errorf("%w: only VP8 IVF files can be published", ErrIncompatibleCodecs)
+	}
+	return nil
+}
+
+func readOggHeader(r io.Reader) error {
+	_, _, err := oggreader.NewWith(r)
+	return err
+}
+
+// playIVF writes each frame at the pace given by the file's timebase
+func playIVF(r io.Reader, track *webrtc.TrackLocalStaticSample, stop <-chan struct{}) error {
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return err
+	}
+
+	frameDuration := time.Millisecond * time.Duration((float32(header.TimebaseNumerator)/float32(header.TimebaseDenominator))*1000)
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		frame, _, err := reader.ParseNextFrame()
+		if err != nil {
+			return err
+		}
+		if err := track.WriteSample(media.Sample{Data: frame, Duration: frameDuration}); err != nil {
+			return err
+		}
+	}
+}
+
+// playOgg writes each page, using the granule position to work out how much audio it holds
+func playOgg(r io.Reader, track *webrtc.TrackLocalStaticSample, stop <-chan struct{}) error {
+	reader, _, err := oggreader.NewWith(r)
+	if err != nil {
+		return err
+	}
+
+	var lastGranule uint64
+	for {
+		page, header, err := reader.ParseNextPage()
+		if err != nil {
+			return err
+		}
+
+		sampleCount := float64(header.GranulePosition - lastGranule)
+		lastGranule = header.GranulePosition
+		duration := time.Duration((sampleCount/48000)*1000) * time.Millisecond
+
+		if err := track.WriteSample(media.Sample{Data: page, Duration: duration}); err != nil {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(duration):
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package sfu
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/types"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	QualityGood = "good"
+	QualityFair = "fair"
+	QualityPoor = "poor"
+)
+
+// ConnectionQuality is a snapshot of the stats gathered for one PeerConnection
+type ConnectionQuality struct {
+	PeerConnection *webrtc.PeerConnection
+	Stats          types.ConnectionStats
+}
+
+// connectionStats aggregates the RTCP receiver reports a peer sends about the tracks we forward to it
+type connectionStats struct {
+	mu           sync.Mutex
+	packetsLost  uint32
+	fractionLost float64
+	jitterMs     float64
+	roundTripMs  float64
+	reports      int
+}
+
+// readSenderRTCP reads receiver reports for a forwarded track until the sender is stopped
+func (s *connectionStats) readSenderRTCP(sender *webrtc.RTPSender, clockRate uint32) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			if rr, ok := p.(*rtcp.ReceiverReport); ok {
+				s.addReceptionReports(rr.Reports, clockRate)
+			}
+		}
+	}
+}
+
+func (s *connectionStats) addReceptionReports(reports []rtcp.ReceptionReport, clockRate uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range reports {
+		s.reports++
+		s.packetsLost = r.TotalLost
+		s.fractionLost = float64(r.FractionLost) / 256
+
+		if clockRate != 0 {
+			s.jitterMs = float64(r.Jitter) / float64(clockRate) * 1000
+		}
+
+		// RTT is only known once the peer has seen one of our sender reports
+		if r.LastSenderReport != 0 {
+			now := ntpMiddle(time.Now())
+			rtt := now - r.LastSenderReport - r.Delay
+			s.roundTripMs = float64(rtt) / 65536 * 1000
+		}
+	}
+}
+
+// snapshot returns the aggregated stats, using the ICE round trip time if no report carried one
+func (s *connectionStats) snapshot(pc *webrtc.PeerConnection) types.ConnectionStats {
+	s.mu.Lock()
+	stats := types.ConnectionStats{
+		PacketsLost:  s.packetsLost,
+		FractionLost: s.fractionLost,
+		JitterMs:     s.jitterMs,
+		RoundTripMs:  s.roundTripMs,
+		Reports:      s.reports,
+	}
+	s.mu.Unlock()
+
+	if stats.RoundTripMs == 0 {
+		for _, st := range pc.GetStats() {
+			pair, ok := st.(webrtc.ICECandidatePairStats)
+			if ok && pair.Nominated {
+				stats.RoundTripMs = pair.CurrentRoundTripTime * 1000
+			}
+		}
+	}
+
+	stats.Quality = score(stats)
+	return stats
+}
+
+// score rates a connection by its worst metric
+func score(stats types.ConnectionStats) string {
+	switch {
+	case stats.FractionLost >= 0.1 || stats.RoundTripMs >= 400 || stats.JitterMs >= 50:
+		return QualityPoor
+	case stats.FractionLost >= 0.03 || stats.RoundTripMs >= 200 || stats.JitterMs >= 30:
+		return QualityFair
+	default:
+		return QualityGood
+	}
+}
+
+// ntpMiddle returns the middle 32 bits of the NTP timestamp for t, as used by LSR in receiver reports
+func ntpMiddle(t time.Time) uint32 {
+	const ntpEpochOffset = 2208988800
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32(secs<<16) | uint32(frac>>16)
+}
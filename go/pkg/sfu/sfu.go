@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Embiggenerd/spiritio/pkg/config"
 	"github.com/Embiggenerd/spiritio/pkg/websocketClient"
 	"github.com/Embiggenerd/spiritio/types"
 	"github.com/pion/rtcp"
@@ -17,27 +18,74 @@ type SFU interface {
 	DispatchKeyFrame()
 	SignalPeerConnections()
 	AddTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP
-	RemoveTrack(t *webrtc.TrackLocalStaticRTP)
-	CreatePeerConnection() (*webrtc.PeerConnection, error)
+	AddLocalTrack(t webrtc.TrackLocal, kind webrtc.RTPCodecType, codec webrtc.RTPCodecParameters)
+	RemoveTrack(t webrtc.TrackLocal)
+	PublishFiles(videoPath, audioPath string, loop bool) (*FilePublisher, error)
+	StopPublisher(streamID string) error
+	CreatePeerConnection(publish bool) (*webrtc.PeerConnection, error)
+	EnablePublishing(pc *webrtc.PeerConnection) error
+	DisablePublishing(pc *webrtc.PeerConnection) error
 	BroadcastMessage(message *types.WebsocketMessage)
-	CountPeerConnections() int
+	CountPublishers() int
+	ConnectionQuality() []ConnectionQuality
+	ValidateCodecs(desc webrtc.SessionDescription) error
+	CreateIngestPeerConnection() (*webrtc.PeerConnection, error)
+	CreateViewerPeerConnection(offer webrtc.SessionDescription) (*webrtc.PeerConnection, error)
+	CountViewers() int
+	Idle() bool
+	Close()
+	StartEgress(trackID, address string) error
+	StopEgress(trackID, address string) error
+	Egress(trackID string, packet []byte)
+	EgressSDP(name string) string
+	Tracks() []types.TrackData
 }
 
 type SFUService struct {
-	trackLocals     map[string]*webrtc.TrackLocalStaticRTP
+	trackLocals     map[string]webrtc.TrackLocal
 	ListLock        sync.RWMutex
 	PeerConnections []PeerConnectionState
+	policy          config.CodecPolicy
+	api             *webrtc.API
+	trackInfos      map[string]trackInfo
+	egressLock      sync.RWMutex
+	egressSinks     map[string][]*egressSink
+	publishers      map[string]*FilePublisher
+	ingest          []*webrtc.PeerConnection
+	viewers         []*webrtc.PeerConnection
+	// receivers holds the transceivers made for each publisher's media. Pion reuses them to send the
+	// room's tracks, which changes their direction, so a connection's direction can't tell who publishes.
+	receivers map[*webrtc.PeerConnection][]*webrtc.RTPTransceiver
 }
 
-func NewSelectiveForwardingUnit() SFU {
-	s := &SFUService{}
-	s.trackLocals = map[string]*webrtc.TrackLocalStaticRTP{}
-	return s
+// trackInfo describes a published track as it was negotiated with its publisher
+type trackInfo struct {
+	streamID string
+	kind     webrtc.RTPCodecType
+	codec    webrtc.RTPCodecParameters
+	// local is set on tracks the server produces itself, which are written as samples rather than forwarded RTP
+	local bool
+}
+
+// NewSelectiveForwardingUnit creates an SFU that negotiates the codecs in the policy, and fails on a codec it doesn't know
+func NewSelectiveForwardingUnit(policy config.CodecPolicy) (SFU, error) {
+	api, err := newAPI(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SFUService{policy: policy, api: api}
+	s.trackLocals = map[string]webrtc.TrackLocal{}
+	s.trackInfos = map[string]trackInfo{}
+	s.egressSinks = map[string][]*egressSink{}
+	s.publishers = map[string]*FilePublisher{}
+	s.receivers = map[*webrtc.PeerConnection][]*webrtc.RTPTransceiver{}
+	return s, nil
 }
 
 func (s *SFUService) AddPeerConnection(pc *webrtc.PeerConnection, w *websocketClient.ThreadSafeWriter) {
 	s.ListLock.Lock()
-	s.PeerConnections = append(s.PeerConnections, PeerConnectionState{PeerConnection: pc, Websocket: w})
+	s.PeerConnections = append(s.PeerConnections, PeerConnectionState{PeerConnection: pc, Websocket: w, stats: &connectionStats{}})
 	s.ListLock.Unlock()
 }
 
@@ -51,13 +99,27 @@ func (s *SFUService) BroadcastMessage(message *types.WebsocketMessage) {
 func (s *SFUService) DispatchKeyFrame() {
 	s.ListLock.Lock()
 	defer s.ListLock.Unlock()
+
+	// Drop ingest connections that have gone away, they are never renegotiated so nothing else will
+	ingest := []*webrtc.PeerConnection{}
+	for _, pc := range s.ingest {
+		if pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			ingest = append(ingest, pc)
+		}
+	}
+	s.ingest = ingest
+
+	pcs := append([]*webrtc.PeerConnection{}, ingest...)
 	for i := range s.PeerConnections {
+		pcs = append(pcs, s.PeerConnections[i].PeerConnection)
+	}
 
-		for _, receiver := range s.PeerConnections[i].PeerConnection.GetReceivers() {
+	for _, pc := range pcs {
+		for _, receiver := range pc.GetReceivers() {
 			if receiver.Track() == nil {
 				continue
 			}
-			err := s.PeerConnections[i].PeerConnection.WriteRTCP([]rtcp.Packet{
+			err := pc.WriteRTCP([]rtcp.Packet{
 				&rtcp.PictureLossIndication{
 					MediaSSRC: uint32(receiver.Track().SSRC()),
 				},
@@ -76,9 +138,12 @@ func (s *SFUService) SignalPeerConnections() {
 		s.DispatchKeyFrame()
 	}()
 
+	s.assignViewerTracks()
+
 	attemptSync := func() (tryAgain bool) {
 		for i := range s.PeerConnections {
 			if s.PeerConnections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+				delete(s.receivers, s.PeerConnections[i].PeerConnection)
 				s.PeerConnections = append(s.PeerConnections[:i], s.PeerConnections[i+1:]...)
 				return true // We modified the slice, start from the beginning
 			}
@@ -113,9 +178,11 @@ func (s *SFUService) SignalPeerConnections() {
 			// Add all track we aren't sending yet to the PeerConnection
 			for trackID := range s.trackLocals {
 				if _, ok := existingSenders[trackID]; !ok {
-					if _, err := s.PeerConnections[i].PeerConnection.AddTrack(s.trackLocals[trackID]); err != nil {
+					sender, err := s.PeerConnections[i].PeerConnection.AddTrack(s.trackLocals[trackID])
+					if err != nil {
 						return true
 					}
+					go s.PeerConnections[i].stats.readSenderRTCP(sender, s.trackInfos[trackID].codec.ClockRate)
 				}
 			}
 
@@ -175,10 +242,23 @@ func (s *SFUService) AddTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP
 	}
 
 	s.trackLocals[t.ID()] = trackLocal
+	s.trackInfos[t.ID()] = trackInfo{streamID: t.StreamID(), kind: t.Kind(), codec: t.Codec()}
 	return trackLocal
 }
 
-func (s *SFUService) RemoveTrack(t *webrtc.TrackLocalStaticRTP) {
+// AddLocalTrack adds a track that is produced by the server itself, and fires renegotiation
+func (s *SFUService) AddLocalTrack(t webrtc.TrackLocal, kind webrtc.RTPCodecType, codec webrtc.RTPCodecParameters) {
+	s.ListLock.Lock()
+	defer func() {
+		s.ListLock.Unlock()
+		s.SignalPeerConnections()
+	}()
+
+	s.trackLocals[t.ID()] = t
+	s.trackInfos[t.ID()] = trackInfo{streamID: t.StreamID(), kind: kind, codec: codec, local: true}
+}
+
+func (s *SFUService) RemoveTrack(t webrtc.TrackLocal) {
 	s.ListLock.Lock()
 	defer func() {
 		s.ListLock.Unlock()
@@ -186,30 +266,193 @@ func (s *SFUService) RemoveTrack(t *webrtc.TrackLocalStaticRTP) {
 	}()
 
 	delete(s.trackLocals, t.ID())
+	delete(s.trackInfos, t.ID())
+	s.stopTrackEgress(t.ID())
 }
 
 type PeerConnectionState struct {
 	PeerConnection *webrtc.PeerConnection
 	Websocket      *websocketClient.ThreadSafeWriter
+	stats          *connectionStats
 }
 
-func (s *SFUService) CreatePeerConnection() (*webrtc.PeerConnection, error) {
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+// CreatePeerConnection creates a PeerConnection for a websocket visitor. Visitors that may not publish
+// only get the room's tracks, and can be given receivers later with EnablePublishing.
+func (s *SFUService) CreatePeerConnection(publish bool) (*webrtc.PeerConnection, error) {
+	peerConnection, err := s.api.NewPeerConnection(webrtc.Configuration{})
 	if err != nil {
 		log.Print(err)
 		return peerConnection, err
 	}
 
+	if publish {
+		err = s.addReceivers(peerConnection)
+	}
+	return peerConnection, err
+}
+
+// EnablePublishing lets a visitor start publishing, renegotiating with every peer
+func (s *SFUService) EnablePublishing(pc *webrtc.PeerConnection) error {
+	// Already able to publish
+	if s.canPublish(pc) {
+		return nil
+	}
+	if err := s.addReceivers(pc); err != nil {
+		return err
+	}
+	s.SignalPeerConnections()
+	return nil
+}
+
+// DisablePublishing stops a visitor's receivers. Their tracks end, which takes them out of the room
+// and renegotiates with every peer. EnablePublishing can give them new receivers later.
+func (s *SFUService) DisablePublishing(pc *webrtc.PeerConnection) error {
+	s.ListLock.Lock()
+	transceivers := s.receivers[pc]
+	delete(s.receivers, pc)
+	s.ListLock.Unlock()
+
+	for _, transceiver := range transceivers {
+		// A receiver Pion reused to send the visitor one of the room's tracks keeps sending it,
+		// only the receiving half stops
+		if sender := transceiver.Sender(); sender != nil && sender.Track() != nil {
+			if err := transceiver.Receiver().Stop(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := transceiver.Stop(); err != nil {
+			return err
+		}
+	}
+	if len(transceivers) > 0 {
+		s.SignalPeerConnections()
+	}
+	return nil
+}
+
+// addReceivers gives a connection transceivers for its peer's media, and records it as a publisher
+func (s *SFUService) addReceivers(pc *webrtc.PeerConnection) error {
+	transceivers := []*webrtc.RTPTransceiver{}
 	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
-		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
+		transceiver, err := pc.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionRecvonly,
-		}); err != nil {
-			return peerConnection, err
+		})
+		if err != nil {
+			return err
 		}
+		transceivers = append(transceivers, transceiver)
+	}
+
+	s.ListLock.Lock()
+	s.receivers[pc] = transceivers
+	s.ListLock.Unlock()
+	return nil
+}
+
+// CreateIngestPeerConnection creates a publish-only PeerConnection that is signaled over HTTP rather
+// than the websocket, so it is kept out of renegotiation and only asked for keyframes
+func (s *SFUService) CreateIngestPeerConnection() (*webrtc.PeerConnection, error) {
+	peerConnection, err := s.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return peerConnection, err
 	}
+
+	s.ListLock.Lock()
+	s.ingest = append(s.ingest, peerConnection)
+	s.ListLock.Unlock()
 	return peerConnection, err
 }
 
-func (s *SFUService) CountPeerConnections() int {
-	return len(s.PeerConnections)
+// CountPublishers counts the open connections that can send media, browsers and WHIP encoders alike.
+// Connections that only receive are not publishers.
+func (s *SFUService) CountPublishers() int {
+	s.ListLock.RLock()
+	defer s.ListLock.RUnlock()
+
+	count := 0
+	for _, pc := range s.ingest {
+		if pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			count++
+		}
+	}
+	for i := range s.PeerConnections {
+		pc := s.PeerConnections[i].PeerConnection
+		if pc.ConnectionState() != webrtc.PeerConnectionStateClosed && len(s.receivers[pc]) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// canPublish reports whether a connection has receivers for its peer's media
+func (s *SFUService) canPublish(pc *webrtc.PeerConnection) bool {
+	s.ListLock.RLock()
+	defer s.ListLock.RUnlock()
+	return len(s.receivers[pc]) > 0
+}
+
+// ConnectionQuality returns the latest aggregated stats for every open PeerConnection
+func (s *SFUService) ConnectionQuality() []ConnectionQuality {
+	s.ListLock.RLock()
+	defer s.ListLock.RUnlock()
+
+	qualities := []ConnectionQuality{}
+	for i := range s.PeerConnections {
+		pc := s.PeerConnections[i].PeerConnection
+		if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			continue
+		}
+		qualities = append(qualities, ConnectionQuality{
+			PeerConnection: pc,
+			Stats:          s.PeerConnections[i].stats.snapshot(pc),
+		})
+	}
+	return qualities
+}
+
+// Idle reports whether nothing is connected to or being published into the SFU
+func (s *SFUService) Idle() bool {
+	s.ListLock.RLock()
+	defer s.ListLock.RUnlock()
+
+	for _, pcs := range [][]*webrtc.PeerConnection{s.ingest, s.viewers} {
+		for _, pc := range pcs {
+			if pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+				return false
+			}
+		}
+	}
+	return len(s.PeerConnections) == 0 && len(s.publishers) == 0
+}
+
+// Close stops every publisher and egress sink and closes every PeerConnection
+func (s *SFUService) Close() {
+	s.ListLock.Lock()
+	pcs := append([]*webrtc.PeerConnection{}, s.ingest...)
+	pcs = append(pcs, s.viewers...)
+	for i := range s.PeerConnections {
+		pcs = append(pcs, s.PeerConnections[i].PeerConnection)
+	}
+	publishers := []*FilePublisher{}
+	for _, p := range s.publishers {
+		publishers = append(publishers, p)
+	}
+	trackIDs := []string{}
+	for id := range s.trackLocals {
+		trackIDs = append(trackIDs, id)
+	}
+	s.ListLock.Unlock()
+
+	for _, p := range publishers {
+		p.Stop()
+	}
+	for _, id := range trackIDs {
+		s.stopTrackEgress(id)
+	}
+	for _, pc := range pcs {
+		if err := pc.Close(); err != nil {
+			log.Println(err)
+		}
+	}
 }
@@ -0,0 +1,182 @@
+package sfu
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/config"
+	"github.com/Embiggenerd/spiritio/pkg/logger"
+	"github.com/Embiggenerd/spiritio/pkg/utils"
+	"github.com/Embiggenerd/spiritio/pkg/websocketClient"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// newTestWriter connects a websocket whose every message the far end reads and throws away
+func newTestWriter(t *testing.T) *websocketClient.ThreadSafeWriter {
+	t.Helper()
+	ctx := utils.WithMetadata(context.Background())
+	utils.ExposeContextMetadata(ctx).Set("requestID", "test")
+	log := &logger.CustomLogger{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	clients := make(chan *websocketClient.WebsocketClient, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := websocketClient.New(ctx, log, w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		clients <- client
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	client := <-clients
+	t.Cleanup(client.Close)
+	return client.Writer
+}
+
+func newTestSFU(t *testing.T) *SFUService {
+	t.Helper()
+	unit, err := NewSelectiveForwardingUnit(config.Defaults().CodecPolicy(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := unit.(*SFUService)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// addPeer connects a websocket visitor to the SFU, as media_request does
+func addPeer(t *testing.T, s *SFUService, publish bool) *webrtc.PeerConnection {
+	t.Helper()
+	pc, err := s.CreatePeerConnection(publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddPeerConnection(pc, newTestWriter(t))
+	return pc
+}
+
+// forwardTestMedia adds video and audio tracks to the SFU as if a publisher's media were being forwarded,
+// which renegotiates with every peer
+func forwardTestMedia(t *testing.T, s *SFUService, streamID string) {
+	t.Helper()
+	video := videoCodecs["vp8"][0]
+	audio := opusCodec(s.policy)
+	for kind, codec := range map[webrtc.RTPCodecType]webrtc.RTPCodecParameters{webrtc.RTPCodecTypeVideo: video, webrtc.RTPCodecTypeAudio: audio} {
+		track, err := webrtc.NewTrackLocalStaticRTP(codec.RTPCodecCapability, streamID+"-"+kind.String(), streamID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.AddLocalTrack(track, kind, codec)
+	}
+}
+
+// TestCountPublishersAfterForwarding keeps counting publishers once Pion has reused their receivers
+// to send them the other publisher's track
+func TestCountPublishersAfterForwarding(t *testing.T) {
+	s := newTestSFU(t)
+	first := addPeer(t, s, true)
+	addPeer(t, s, true)
+	addPeer(t, s, false)
+
+	if count := s.CountPublishers(); count != 2 {
+		t.Fatalf("counted %d publishers before forwarding, want 2", count)
+	}
+
+	forwardTestMedia(t, s, "second")
+	for _, transceiver := range first.GetTransceivers() {
+		if transceiver.Direction() == webrtc.RTPTransceiverDirectionRecvonly {
+			t.Error("the forwarded media did not reuse every receiver, so this test no longer covers that")
+		}
+	}
+	if count := s.CountPublishers(); count != 2 {
+		t.Errorf("counted %d publishers after forwarding, want 2", count)
+	}
+}
+
+// TestDisablePublishingAfterForwarding stops an audience member's receivers whatever Pion has made of them,
+// without stopping the tracks they are sent
+func TestDisablePublishingAfterForwarding(t *testing.T) {
+	s := newTestSFU(t)
+	audience := addPeer(t, s, true)
+	addPeer(t, s, true)
+	forwardTestMedia(t, s, "presenter")
+
+	if err := s.DisablePublishing(audience); err != nil {
+		t.Fatal(err)
+	}
+	if count := s.CountPublishers(); count != 1 {
+		t.Errorf("counted %d publishers after disabling one of two, want 1", count)
+	}
+	sent := 0
+	for _, transceiver := range audience.GetTransceivers() {
+		if transceiver.Receiver() == nil {
+			continue
+		}
+		if !receiverStopped(transceiver.Receiver()) {
+			t.Errorf("the %s receiver was left running", transceiver.Kind())
+		}
+		if sender := transceiver.Sender(); sender != nil && sender.Track() != nil {
+			sent++
+		}
+	}
+	if sent != 2 {
+		t.Errorf("%d of the room's tracks are still sent to the audience member, want 2", sent)
+	}
+
+	if err := s.EnablePublishing(audience); err != nil {
+		t.Fatal(err)
+	}
+	if count := s.CountPublishers(); count != 2 {
+		t.Errorf("counted %d publishers after enabling publishing again, want 2", count)
+	}
+}
+
+// receiverStopped reports whether a receiver was stopped, which makes reading from it fail straight away
+// rather than wait for media
+func receiverStopped(receiver *webrtc.RTPReceiver) bool {
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := receiver.ReadRTCP()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		return err != nil
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+// TestCodecPolicy keeps the codec names config accepts in step with the codecs the SFU can negotiate
+func TestCodecPolicy(t *testing.T) {
+	policy := config.CodecPolicy{VideoCodecs: config.VideoCodecNames, AudioCodecs: config.AudioCodecNames}
+	if _, err := NewSelectiveForwardingUnit(policy); err != nil {
+		t.Errorf("a codec config accepts was refused: %v", err)
+	}
+
+	policy.VideoCodecs = []string{"H265"}
+	if _, err := NewSelectiveForwardingUnit(policy); err == nil {
+		t.Error("an unknown codec was accepted instead of being rejected")
+	}
+}
@@ -0,0 +1,113 @@
+package sfu
+
+import (
+	"log"
+	"sort"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// CreateViewerPeerConnection creates a receive-only PeerConnection for a viewer that is signaled over HTTP.
+// Viewers can't be renegotiated, so they get one sendonly transceiver per media section in their offer,
+// and room tracks are swapped in and out of those as publishers come and go.
+func (s *SFUService) CreateViewerPeerConnection(offer webrtc.SessionDescription) (*webrtc.PeerConnection, error) {
+	parsed, err := offer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	peerConnection, err := s.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, md := range parsed.MediaDescriptions {
+		kind := webrtc.NewRTPCodecType(md.MediaName.Media)
+		if kind == 0 {
+			continue
+		}
+		transceiver, err := peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			peerConnection.Close()
+			return nil, err
+		}
+		go discardRTCP(transceiver.Sender())
+	}
+
+	s.ListLock.Lock()
+	s.viewers = append(s.viewers, peerConnection)
+	s.assignViewerTracks()
+	s.ListLock.Unlock()
+
+	return peerConnection, nil
+}
+
+// CountViewers returns the number of open viewer PeerConnections
+func (s *SFUService) CountViewers() int {
+	s.ListLock.RLock()
+	defer s.ListLock.RUnlock()
+
+	n := 0
+	for _, pc := range s.viewers {
+		if pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			n++
+		}
+	}
+	return n
+}
+
+// assignViewerTracks gives each viewer transceiver a distinct room track of its kind, in a stable order.
+// The caller must hold ListLock.
+func (s *SFUService) assignViewerTracks() {
+	trackIDs := make([]string, 0, len(s.trackLocals))
+	for id := range s.trackLocals {
+		trackIDs = append(trackIDs, id)
+	}
+	sort.Strings(trackIDs)
+
+	viewers := []*webrtc.PeerConnection{}
+	for _, pc := range s.viewers {
+		if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			continue
+		}
+		viewers = append(viewers, pc)
+
+		used := map[string]bool{}
+		for _, transceiver := range pc.GetTransceivers() {
+			sender := transceiver.Sender()
+			if sender == nil {
+				continue
+			}
+
+			var next webrtc.TrackLocal
+			for _, id := range trackIDs {
+				if !used[id] && s.trackInfos[id].kind == transceiver.Kind() {
+					next = s.trackLocals[id]
+					used[id] = true
+					break
+				}
+			}
+
+			current := sender.Track()
+			if next == nil || (current != nil && current.ID() == next.ID()) {
+				continue
+			}
+			if err := sender.ReplaceTrack(next); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	s.viewers = viewers
+}
+
+// discardRTCP keeps a sender's interceptors running for senders whose reports we don't aggregate
+func discardRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
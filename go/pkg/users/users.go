@@ -102,9 +102,10 @@ func (s *UsersService) ValidateAccessToken(tokenString string) (*jwt.Token, erro
 	}
 
 	claims := token.Claims.(*CustomClaims)
-	expired := claims.ExpiresAt.Time.Before(time.Now())
+	expired := claims.ExpiresAt == nil || claims.ExpiresAt.Time.Before(time.Now())
 
-	if !token.Valid || expired {
+	// Access tokens always name a user and never carry an audience. Tokens made for anything else, like room invites, are not access tokens.
+	if !token.Valid || expired || claims.UserID == 0 || len(claims.Audience) > 0 {
 		err = errors.New("permission denied")
 	}
 
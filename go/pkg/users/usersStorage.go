@@ -22,7 +22,8 @@ type UsersStorage struct {
 
 func (s *UsersStorage) getUserByID(userID uint) (*User, error) {
 	foundUser := &User{}
-	userResult := s.db.DB.Where(User{ID: userID}).First(foundUser)
+	// A struct condition would drop a zero id and match every user
+	userResult := s.db.DB.Where("id = ?", userID).First(foundUser)
 
 	return foundUser, userResult.Error
 }
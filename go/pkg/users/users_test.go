@@ -0,0 +1,88 @@
+package users
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/config"
+	"github.com/Embiggenerd/spiritio/pkg/db"
+	"github.com/Embiggenerd/spiritio/pkg/logger"
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+func newTestService(t *testing.T) *UsersService {
+	t.Helper()
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &logger.CustomLogger{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	return NewUsersService(context.Background(), config.Defaults(), log, database).(*UsersService)
+}
+
+func sign(t *testing.T, s *UsersService, claims CustomClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(s.cfg.AccessTokenSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidateAccessToken(t *testing.T) {
+	s := newTestService(t)
+	user, token, err := s.CreateUser(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := s.ValidateAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := s.GetUserFromAccessToken(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != user.ID {
+		t.Errorf("token signed in user %d, want %d", found.ID, user.ID)
+	}
+
+	expiresAt := jwt.NewNumericDate(time.Now().Add(time.Hour))
+	rejected := map[string]string{
+		"no user": sign(t, s, CustomClaims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: expiresAt}}),
+		"audience": sign(t, s, CustomClaims{UserID: user.ID, RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: expiresAt,
+			Audience:  jwt.ClaimStrings{"room_invite"},
+		}}),
+		"no expiry": sign(t, s, CustomClaims{UserID: user.ID}),
+		"expired": sign(t, s, CustomClaims{UserID: user.ID, RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+		}}),
+		"wrong secret": func() string {
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, CustomClaims{UserID: user.ID, RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: expiresAt,
+			}}).SignedString([]byte("not our secret"))
+			return token
+		}(),
+	}
+	for name, token := range rejected {
+		if _, err := s.ValidateAccessToken(token); err == nil {
+			t.Errorf("token with %s was accepted", name)
+		}
+	}
+}
+
+func TestGetUserByZeroID(t *testing.T) {
+	s := newTestService(t)
+	if _, _, err := s.CreateUser(false); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := s.GetUserByID(0); err == nil {
+		t.Errorf("user id 0 found user %d", user.ID)
+	}
+}
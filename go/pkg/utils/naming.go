@@ -1,8 +1,11 @@
 package utils
 
 import (
+	crand "crypto/rand"
+	"math/big"
 	"math/rand"
 	"strconv"
+	"strings"
 
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
@@ -1344,3 +1347,22 @@ func RandName() string {
 
 	return cases.Title(language.English).String(name)
 }
+
+// RandSlug makes an unguessable, human friendly room slug such as "abashed-red-panda-4821".
+// It draws from crypto/rand, since a slug is all it takes to find a room.
+func RandSlug() string {
+	adj := adjectives[secureIntn(len(adjectives))]
+	ani := animals[secureIntn(len(animals))]
+	num := strconv.Itoa(secureIntn(10000))
+	slug := adj + "-" + ani + "-" + num
+
+	return strings.ToLower(strings.ReplaceAll(slug, " ", "-"))
+}
+
+func secureIntn(n int) int {
+	i, err := crand.Int(crand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(i.Int64())
+}
@@ -2,14 +2,28 @@ package websocketClient
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/Embiggenerd/spiritio/pkg/logger"
 	"github.com/Embiggenerd/spiritio/types"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// sendQueueSize is how many messages can wait to be written to a client before it is cut off
+	sendQueueSize = 256
+	// writeWait is how long a client gets to take a message before it is cut off
+	writeWait = 10 * time.Second
+)
+
+var (
+	ErrSendQueueFull = errors.New("client is not keeping up with its messages")
+	ErrClientClosed  = errors.New("client is closed")
+)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -25,10 +39,14 @@ type WebsocketClient struct {
 func New(ctx context.Context, log logger.Logger, w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*WebsocketClient, error) {
 	unsafeConn, err := upgrader.Upgrade(w, r, responseHeader)
 	writer := &ThreadSafeWriter{
-		unsafeConn,
-		sync.Mutex{},
-		ctx,
-		log,
+		Conn:    unsafeConn,
+		ctx:     ctx,
+		log:     log,
+		queue:   make(chan *types.WebsocketMessage, sendQueueSize),
+		closing: make(chan struct{}),
+	}
+	if err == nil {
+		go writer.run()
 	}
 	client := &WebsocketClient{
 		Conn:   writer.Conn,
@@ -37,10 +55,14 @@ func New(ctx context.Context, log logger.Logger, w http.ResponseWriter, r *http.
 	return client, err
 }
 
-func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
-	t.Lock()
-	defer t.Unlock()
+// Close sends the client whatever is already queued for it, then closes its connection
+func (c *WebsocketClient) Close() {
+	c.Writer.Close()
+}
 
+// WriteJSON queues a message for the client without waiting for it to be written, so a slow client
+// never holds up whoever is writing to it. A client that lets its queue fill up is closed.
+func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
 	message := &types.WebsocketMessage{
 		Data: v,
 	}
@@ -50,16 +72,69 @@ func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
 	case *types.Question:
 		message.Type = "question"
 	}
-	t.log.LogMessageSent(t.ctx, message)
 
+	select {
+	case <-t.closing:
+		return ErrClientClosed
+	default:
+	}
+	select {
+	case t.queue <- message:
+		t.log.LogMessageSent(t.ctx, message)
+		return nil
+	default:
+		t.Close()
+		return ErrSendQueueFull
+	}
+}
+
+// Close stops taking messages and closes the connection once the queued ones are written
+func (t *ThreadSafeWriter) Close() {
+	t.closeOnce.Do(func() {
+		close(t.closing)
+	})
+}
+
+// run writes queued messages to the connection one at a time, the only goroutine that does
+func (t *ThreadSafeWriter) run() {
+	defer t.Conn.Close()
+	for {
+		select {
+		case message := <-t.queue:
+			if err := t.write(message); err != nil {
+				t.Close()
+				return
+			}
+		case <-t.closing:
+			// Flush what is left, with one deadline for all of it in case the client has stalled
+			t.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+			for {
+				select {
+				case message := <-t.queue:
+					if err := t.Conn.WriteJSON(message); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *ThreadSafeWriter) write(message *types.WebsocketMessage) error {
+	t.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 	return t.Conn.WriteJSON(message)
 }
 
+// ThreadSafeWriter writes to a websocket from any goroutine, through a queue that a goroutine of its own drains
 type ThreadSafeWriter struct {
 	*websocket.Conn
-	sync.Mutex
-	ctx context.Context
-	log logger.Logger
+	ctx       context.Context
+	log       logger.Logger
+	queue     chan *types.WebsocketMessage
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 type JoinRoomWebsocketMessage struct {
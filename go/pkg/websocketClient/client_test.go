@@ -0,0 +1,101 @@
+package websocketClient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Embiggenerd/spiritio/pkg/logger"
+	"github.com/Embiggenerd/spiritio/pkg/utils"
+	"github.com/Embiggenerd/spiritio/types"
+	"github.com/gorilla/websocket"
+)
+
+// newTestPair connects a client to a websocket the test reads from itself, if it wants to
+func newTestPair(t *testing.T) (*WebsocketClient, *websocket.Conn) {
+	t.Helper()
+	ctx := utils.WithMetadata(context.Background())
+	utils.ExposeContextMetadata(ctx).Set("requestID", "test")
+	log := &logger.CustomLogger{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	clients := make(chan *WebsocketClient, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := New(ctx, log, w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		clients <- client
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := <-clients
+	t.Cleanup(client.Close)
+	return client, conn
+}
+
+func TestWriteJSONInOrderAndFlushedOnClose(t *testing.T) {
+	client, conn := newTestPair(t)
+	for i := 0; i < 10; i++ {
+		if err := client.Writer.WriteJSON(&types.Event{Event: "test", Data: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+	if err := client.Writer.WriteJSON(&types.Event{Event: "late"}); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("wrote to a closed client: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("message %d was not written before the connection closed: %v", i, err)
+		}
+		message := struct {
+			Data types.Event `json:"data"`
+		}{}
+		if err := json.Unmarshal(raw, &message); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := message.Data.Data.(float64); int(n) != i {
+			t.Fatalf("got message %v, want %d", message.Data.Data, i)
+		}
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("the connection stayed open after it was closed")
+	}
+}
+
+// TestWriteJSONStalledClient never waits on a client that stopped reading, and cuts it off once its queue is full
+func TestWriteJSONStalledClient(t *testing.T) {
+	client, _ := newTestPair(t)
+	big := strings.Repeat("x", 64*1024)
+
+	started := time.Now()
+	var err error
+	for i := 0; i < 10*sendQueueSize && err == nil; i++ {
+		err = client.Writer.WriteJSON(&types.Event{Event: "test", Data: big})
+	}
+	if !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("a client that reads nothing was never cut off: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("writing to a stalled client took %v", elapsed)
+	}
+	if err := client.Writer.WriteJSON(&types.Event{Event: "test"}); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("a client that was cut off still takes messages: %v", err)
+	}
+}
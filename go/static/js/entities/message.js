@@ -15,12 +15,19 @@ const messageService = {
         this.conn.send(JSON.stringify(message))
     },
     connect: function () {
+        // Sending the access token up front lets hosts into rooms that are locked or full
+        const params = new URLSearchParams(window.location.search)
+        const accessToken = localStorage.getItem('access_token')
+        if (accessToken) {
+            params.set('access_token', accessToken)
+        }
+        const search = params.toString()
         const url =
             this.scheme +
             '://' +
             window.location.host +
             this.path +
-            window.location.search
+            (search ? '?' + search : '')
         return new this.webSocket(url)
     },
     assignCallbacks: function (
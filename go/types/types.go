@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type WebsocketMessage struct {
 	Type string      `json:"type,omitempty"`
 	Data interface{} `json:"data,omitempty"`
@@ -20,10 +22,16 @@ type WorkOrder struct {
 }
 
 type JoinedRoomData struct {
-	RoomID   uint              `json:"room_id,omitempty"`
-	ChatLog  []UserMessageData `json:"chat_log"`
-	Name     string            `json:"name,omitempty"`
-	Visitors []Visitor         `json:"visitors"`
+	RoomID      uint              `json:"room_id,omitempty"`
+	ChatLog     []UserMessageData `json:"chat_log"`
+	ChatCursor  uint              `json:"chat_cursor,omitempty"`
+	HasMoreChat bool              `json:"has_more_chat"`
+	Name        string            `json:"name,omitempty"`
+	Visitors    []Visitor         `json:"visitors"`
+	Mode        string            `json:"mode,omitempty"`
+	Presenters  []Visitor         `json:"presenters"`
+	Room        RoomData          `json:"room"`
+	Roles       []RoleData        `json:"roles"`
 }
 
 type Visitor struct {
@@ -54,17 +62,33 @@ type DirectMessageData struct {
 	FromUserID uint
 }
 
+// UserMessageData is a chat message. Saved messages carry their id, the time the server
+// saved them and their sequence number, which only goes up within a room.
 type UserMessageData struct {
-	Text         string `json:"text,omitempty"`
-	FromUserName string `json:"from_user_name,omitempty"`
-	FromUserID   uint   `json:"from_user_id,omitempty"`
-	UserVerified bool   `json:"user_verified"`
-	ToUserID     uint   `json:"to_user_id,omitempty"`
+	ID              uint           `json:"id,omitempty"`
+	Seq             uint64         `json:"seq,omitempty"`
+	SentAt          time.Time      `json:"sent_at"`
+	ClientMessageID string         `json:"client_message_id,omitempty"`
+	EditedAt        *time.Time     `json:"edited_at,omitempty"`
+	Deleted         bool           `json:"deleted,omitempty"`
+	Reactions       []ReactionData `json:"reactions,omitempty"`
+	ParentID        *uint          `json:"parent_id,omitempty"`
+	ReplyCount      int            `json:"reply_count,omitempty"`
+	LastReplyAt     *time.Time     `json:"last_reply_at,omitempty"`
+	Text            string         `json:"text,omitempty"`
+	FromUserName    string         `json:"from_user_name,omitempty"`
+	FromUserID      uint           `json:"from_user_id,omitempty"`
+	UserVerified    bool           `json:"user_verified"`
+	ToUserID        uint           `json:"to_user_id,omitempty"`
 }
 
+// UserMessageWorkOrderDetail is a message to send. Resending it with the same ClientMessageID does not send it twice.
 type UserMessageWorkOrderDetail struct {
-	Text     string
-	ToUserID uint
+	Text            string
+	ToUserID        uint
+	ClientMessageID string `json:"client_message_id"`
+	// ParentID makes the message a reply in the thread under that message
+	ParentID *uint `json:"parent_id"`
 }
 
 type UserMessageWorkOrder struct {
@@ -83,3 +107,426 @@ type CurrentGuest struct {
 }
 
 type CurrentGuestsData []CurrentGuest
+
+type ConnectionStats struct {
+	PacketsLost  uint32  `json:"packets_lost"`
+	FractionLost float64 `json:"fraction_lost"`
+	JitterMs     float64 `json:"jitter_ms"`
+	RoundTripMs  float64 `json:"round_trip_ms"`
+	Reports      int     `json:"reports"`
+	Quality      string  `json:"quality"`
+}
+
+type ConnectionQualityData struct {
+	UserID   uint            `json:"user_id,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	StreamID string          `json:"stream_id,omitempty"`
+	Quality  string          `json:"quality"`
+	Stats    ConnectionStats `json:"stats"`
+}
+
+type TrackData struct {
+	ID       string `json:"id"`
+	StreamID string `json:"stream_id"`
+	Kind     string `json:"kind"`
+	MimeType string `json:"mime_type"`
+}
+
+type EgressWorkOrderDetail struct {
+	TrackID string `json:"track_id"`
+	Address string `json:"address"`
+}
+
+type EgressWorkOrder struct {
+	Order   string
+	Details EgressWorkOrderDetail
+}
+
+type EgressData struct {
+	TrackID  string `json:"track_id,omitempty"`
+	Address  string `json:"address,omitempty"`
+	FileName string `json:"file_name"`
+	SDP      string `json:"sdp"`
+}
+
+type PublishFileWorkOrderDetail struct {
+	Video string `json:"video"`
+	Audio string `json:"audio"`
+	Loop  bool   `json:"loop"`
+}
+
+type PublishFileWorkOrder struct {
+	Order   string
+	Details PublishFileWorkOrderDetail
+}
+
+type FilePublisherData struct {
+	StreamID string `json:"stream_id"`
+	Video    string `json:"video,omitempty"`
+	Audio    string `json:"audio,omitempty"`
+}
+
+type RoomModeData struct {
+	Mode       string    `json:"mode"`
+	Presenters []Visitor `json:"presenters"`
+}
+
+type RoomClosedData struct {
+	RoomID uint   `json:"room_id"`
+	Reason string `json:"reason"`
+}
+
+type RoomSettingsData struct {
+	ChatEnabled  bool `json:"chat_enabled"`
+	VideoEnabled bool `json:"video_enabled"`
+	MaxSize      int  `json:"max_size"`
+	Locked       bool `json:"locked"`
+	LobbyEnabled bool `json:"lobby_enabled"`
+	InviteOnly   bool `json:"invite_only"`
+	HasPasscode  bool `json:"has_passcode"`
+	Public       bool `json:"public"`
+}
+
+type RoomData struct {
+	ID          uint             `json:"id"`
+	Slug        string           `json:"slug"`
+	Name        string           `json:"name"`
+	Topic       string           `json:"topic"`
+	OwnerID     uint             `json:"owner_id"`
+	CreatedByID uint             `json:"created_by_id"`
+	Mode        string           `json:"mode"`
+	Settings    RoomSettingsData `json:"settings"`
+	Schedule    ScheduleData     `json:"schedule"`
+	ParentID    *uint            `json:"parent_id"`
+}
+
+// UpdateRoomWorkOrderDetail only changes the fields that are set
+type UpdateRoomWorkOrderDetail struct {
+	Name         *string `json:"name"`
+	Topic        *string `json:"topic"`
+	ChatEnabled  *bool   `json:"chat_enabled"`
+	VideoEnabled *bool   `json:"video_enabled"`
+	MaxSize      *int    `json:"max_size"`
+	Locked       *bool   `json:"locked"`
+	LobbyEnabled *bool   `json:"lobby_enabled"`
+	InviteOnly   *bool   `json:"invite_only"`
+	// Passcode is hashed before it is stored, an empty one removes it
+	Passcode *string `json:"passcode"`
+	Public   *bool   `json:"public"`
+}
+
+type UpdateRoomWorkOrder struct {
+	Order   string
+	Details UpdateRoomWorkOrderDetail
+}
+
+type RoleData struct {
+	UserID uint   `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type SetRoleWorkOrderDetail struct {
+	UserID uint   `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type SetRoleWorkOrder struct {
+	Order   string
+	Details SetRoleWorkOrderDetail
+}
+
+type KickedData struct {
+	RoomID uint   `json:"room_id"`
+	Reason string `json:"reason"`
+}
+
+type UserRemovedData struct {
+	UserID uint   `json:"user_id"`
+	Reason string `json:"reason"`
+	Banned bool   `json:"banned"`
+}
+
+type BanData struct {
+	RoomID     uint       `json:"room_id"`
+	UserID     uint       `json:"user_id"`
+	BannedByID uint       `json:"banned_by_id"`
+	Reason     string     `json:"reason"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// RemoveUserWorkOrderDetail is used by kick, ban and unban. A ban with no Duration, in seconds, never expires.
+type RemoveUserWorkOrderDetail struct {
+	UserID   uint   `json:"user_id"`
+	Reason   string `json:"reason"`
+	Duration int    `json:"duration"`
+}
+
+type RemoveUserWorkOrder struct {
+	Order   string
+	Details RemoveUserWorkOrderDetail
+}
+
+type LobbyWorkOrderDetail struct {
+	UserID uint `json:"user_id"`
+}
+
+type LobbyWorkOrder struct {
+	Order   string
+	Details LobbyWorkOrderDetail
+}
+
+// CreateInviteWorkOrderDetail asks for an invite token. ExpiresIn is in seconds and defaults to a day,
+// a zero MaxUses means unlimited and Role defaults to member.
+type CreateInviteWorkOrderDetail struct {
+	Role      string `json:"role"`
+	ExpiresIn int    `json:"expires_in"`
+	MaxUses   int    `json:"max_uses"`
+}
+
+type CreateInviteWorkOrder struct {
+	Order   string
+	Details CreateInviteWorkOrderDetail
+}
+
+type InviteData struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	RoomID    uint      `json:"room_id"`
+	Role      string    `json:"role"`
+	MaxUses   int       `json:"max_uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DirectoryRoomData describes a public room to people looking for one
+type DirectoryRoomData struct {
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+	Topic    string `json:"topic"`
+	Private  bool   `json:"private"`
+	Visitors int    `json:"visitors"`
+	Live     bool   `json:"live"`
+}
+
+// ScheduleData is when a room's meeting happens. Invitees are only sent to hosts.
+type ScheduleData struct {
+	StartsAt   *time.Time `json:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at"`
+	Recurrence string     `json:"recurrence"`
+	Invitees   []string   `json:"invitees,omitempty"`
+}
+
+type SetScheduleWorkOrder struct {
+	Order   string                     `json:"order"`
+	Details SetScheduleWorkOrderDetail `json:"details"`
+}
+
+// SetScheduleWorkOrderDetail replaces a room's schedule. Leaving out starts_at clears it.
+type SetScheduleWorkOrderDetail struct {
+	StartsAt   *time.Time `json:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at"`
+	Recurrence string     `json:"recurrence"`
+	Invitees   []string   `json:"invitees"`
+}
+
+// MeetingData describes one meeting of a room's schedule. EndsAt is left out for meetings without an end.
+type MeetingData struct {
+	RoomID   uint       `json:"room_id"`
+	StartsAt time.Time  `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+}
+
+type CreateBreakoutsWorkOrder struct {
+	Order   string                         `json:"order"`
+	Details CreateBreakoutsWorkOrderDetail `json:"details"`
+}
+
+// CreateBreakoutsWorkOrderDetail splits a room into Count breakouts. Assignment is random or manual,
+// and Assignments place users by hand either way. A Duration in seconds recalls everyone when it runs out.
+type CreateBreakoutsWorkOrderDetail struct {
+	Count       int                  `json:"count"`
+	Assignment  string               `json:"assignment"`
+	Assignments []BreakoutAssignment `json:"assignments"`
+	Duration    int                  `json:"duration"`
+}
+
+// BreakoutAssignment puts a user in a breakout, numbered from 1
+type BreakoutAssignment struct {
+	UserID uint `json:"user_id"`
+	Room   int  `json:"room"`
+}
+
+type RecallBreakoutsWorkOrder struct {
+	Order   string                         `json:"order"`
+	Details RecallBreakoutsWorkOrderDetail `json:"details"`
+}
+
+// RecallBreakoutsWorkOrderDetail calls everyone back after Countdown seconds, or straight away
+type RecallBreakoutsWorkOrderDetail struct {
+	Countdown int `json:"countdown"`
+}
+
+// MovedToRoomData tells a client to reconnect to another room
+type MovedToRoomData struct {
+	RoomID uint       `json:"room_id"`
+	Slug   string     `json:"slug"`
+	Name   string     `json:"name"`
+	EndsAt *time.Time `json:"ends_at,omitempty"`
+}
+
+type BreakoutData struct {
+	RoomID   uint   `json:"room_id"`
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+	Visitors int    `json:"visitors"`
+}
+
+// BreakoutsData lists a room's open breakouts and when they will be recalled
+type BreakoutsData struct {
+	ParentID uint           `json:"parent_id"`
+	EndsAt   *time.Time     `json:"ends_at,omitempty"`
+	Rooms    []BreakoutData `json:"rooms"`
+}
+
+// AttendanceData is one visitor session in a room. LeftAt is null while it is under way.
+type AttendanceData struct {
+	ID              uint       `json:"id"`
+	UserID          uint       `json:"user_id"`
+	UserName        string     `json:"user_name"`
+	RoomID          uint       `json:"room_id"`
+	JoinedAt        time.Time  `json:"joined_at"`
+	LeftAt          *time.Time `json:"left_at"`
+	DurationSeconds int64      `json:"duration_seconds"`
+	PublishedMedia  bool       `json:"published_media"`
+	ClientIP        string     `json:"client_ip"`
+}
+
+type EditMessageWorkOrder struct {
+	Order   string                     `json:"order"`
+	Details EditMessageWorkOrderDetail `json:"details"`
+}
+
+// EditMessageWorkOrderDetail replaces the text of a saved message
+type EditMessageWorkOrderDetail struct {
+	ID   uint   `json:"id"`
+	Text string `json:"text"`
+}
+
+type DeleteMessageWorkOrder struct {
+	Order   string                       `json:"order"`
+	Details DeleteMessageWorkOrderDetail `json:"details"`
+}
+
+type DeleteMessageWorkOrderDetail struct {
+	ID uint `json:"id"`
+}
+
+type ReactionWorkOrder struct {
+	Order   string                  `json:"order"`
+	Details ReactionWorkOrderDetail `json:"details"`
+}
+
+// ReactionWorkOrderDetail adds or removes the sender's reaction to a message
+type ReactionWorkOrderDetail struct {
+	MessageID uint   `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionData counts the users who reacted to a message with an emoji
+type ReactionData struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	UserIDs []uint `json:"user_ids"`
+}
+
+// ReactionsData is every reaction to a message, after one of them changed
+type ReactionsData struct {
+	MessageID uint           `json:"message_id"`
+	Reactions []ReactionData `json:"reactions"`
+}
+
+type GetThreadWorkOrder struct {
+	Order   string                   `json:"order"`
+	Details GetThreadWorkOrderDetail `json:"details"`
+}
+
+// GetThreadWorkOrderDetail asks for the replies to a message, oldest first, after a cursor
+type GetThreadWorkOrderDetail struct {
+	MessageID uint `json:"message_id"`
+	After     uint `json:"after"`
+	Limit     int  `json:"limit"`
+}
+
+// ThreadData is a message and a page of its replies. After is the cursor for the next page.
+type ThreadData struct {
+	Parent  UserMessageData   `json:"parent"`
+	Replies []UserMessageData `json:"replies"`
+	After   uint              `json:"after"`
+	HasMore bool              `json:"has_more"`
+}
+
+// ThreadSummaryData is how many replies a message has and when the latest was sent
+type ThreadSummaryData struct {
+	MessageID   uint       `json:"message_id"`
+	ReplyCount  int        `json:"reply_count"`
+	LastReplyAt *time.Time `json:"last_reply_at"`
+}
+
+type SearchMessagesWorkOrder struct {
+	Order   string                        `json:"order"`
+	Details SearchMessagesWorkOrderDetail `json:"details"`
+}
+
+// SearchMessagesWorkOrderDetail searches messages across the rooms the sender can read.
+// AuthorID, Room (a slug), From and To narrow the search when set.
+type SearchMessagesWorkOrderDetail struct {
+	Query    string     `json:"query"`
+	AuthorID uint       `json:"author_id"`
+	Room     string     `json:"room"`
+	From     *time.Time `json:"from"`
+	To       *time.Time `json:"to"`
+	Limit    int        `json:"limit"`
+	Offset   int        `json:"offset"`
+}
+
+// MessageSearchResultData is a message that matched a search. Snippet is HTML, with the matched words in mark elements.
+type MessageSearchResultData struct {
+	MessageID    uint      `json:"message_id"`
+	ParentID     *uint     `json:"parent_id,omitempty"`
+	RoomID       uint      `json:"room_id"`
+	RoomSlug     string    `json:"room_slug"`
+	RoomName     string    `json:"room_name"`
+	FromUserID   uint      `json:"from_user_id"`
+	FromUserName string    `json:"from_user_name"`
+	ToUserID     uint      `json:"to_user_id,omitempty"`
+	SentAt       time.Time `json:"sent_at"`
+	Snippet      string    `json:"snippet"`
+}
+
+// MessageSearchData is a page of search results, best matches first
+type MessageSearchData struct {
+	Query   string                    `json:"query"`
+	Results []MessageSearchResultData `json:"results"`
+	HasMore bool                      `json:"has_more"`
+}
+
+type ChatHistoryWorkOrder struct {
+	Order   string                     `json:"order"`
+	Details ChatHistoryWorkOrderDetail `json:"details"`
+}
+
+// ChatHistoryWorkOrderDetail asks for a page of messages before or after a cursor.
+// Without either it is the most recent page.
+type ChatHistoryWorkOrderDetail struct {
+	Before uint `json:"before"`
+	After  uint `json:"after"`
+	Limit  int  `json:"limit"`
+}
+
+// ChatHistoryData is a page of messages, oldest first. Before and After are the cursors for the pages either side of it.
+type ChatHistoryData struct {
+	Messages []UserMessageData `json:"messages"`
+	Before   uint              `json:"before"`
+	After    uint              `json:"after"`
+	HasMore  bool              `json:"has_more"`
+}